@@ -0,0 +1,46 @@
+// derivatives generates missing preset sizes for all stored images
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/jeyem/gocommerce/lib/file"
+	"github.com/jeyem/mogo"
+)
+
+func main() {
+	var (
+		mongo   = flag.String("db", "127.0.0.1:27017/gocommerce", "mongodb address and database")
+		path    = flag.String("path", "", "files root directory (file.Config.ImagePath)")
+		workers = flag.Int("workers", 4, "parallel workers")
+		retries = flag.Int("retries", 3, "retries for each file")
+	)
+	flag.Parse()
+	if *path == "" {
+		log.Fatal("-path is required")
+	}
+	database, err := mogo.Conn(*mongo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	file.Register(database, file.Config{ImagePath: *path})
+
+	queue := file.NewQueue(*workers)
+	queue.Retries = *retries
+	queue.Progress = func(p file.Progress) {
+		if p.Err != nil {
+			log.Printf("[%d/%d] %s failed: %v", p.Done+p.Failed, p.Total, p.File.Path, p.Err)
+			return
+		}
+		log.Printf("[%d/%d] %s", p.Done+p.Failed, p.Total, p.File.Path)
+	}
+	queue.Start()
+	count, err := file.Backfill(queue)
+	queue.Stop()
+	if err != nil {
+		log.Fatal(err)
+	}
+	done, failed, _ := queue.Stats()
+	log.Printf("backfill finished: %d files, %d done, %d failed", count, done, failed)
+}
@@ -0,0 +1,61 @@
+// importusers imports users of another store from a csv or json export,
+// their password hashes are kept and upgraded at first login
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/jeyem/gocommerce/lib/user"
+	"github.com/jeyem/mogo"
+)
+
+func main() {
+	var (
+		mongo  = flag.String("db", "127.0.0.1:27017/gocommerce", "mongodb address and database")
+		path   = flag.String("file", "", "csv or json export of users")
+		format = flag.String("format", "", "csv or json, by extension of -file when empty")
+	)
+	flag.Parse()
+	if *path == "" {
+		log.Fatal("-file is required")
+	}
+	if *format == "" {
+		*format = filepath.Ext(*path)
+		if len(*format) > 0 {
+			*format = (*format)[1:]
+		}
+	}
+	f, err := os.Open(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	var records []user.ImportRecord
+	switch *format {
+	case "csv":
+		records, err = user.ReadCSV(f)
+	case "json":
+		records, err = user.ReadJSON(f)
+	default:
+		log.Fatalf("unknown format %q", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	database, err := mogo.Conn(*mongo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	user.Register(database)
+
+	report := user.Import(records)
+	for _, err := range report.Errors {
+		log.Print(err)
+	}
+	log.Printf("import finished: %d records, %d created, %d duplicates, %d failed",
+		len(records), report.Created, report.Duplicates, len(report.Errors))
+}
@@ -0,0 +1,209 @@
+package file
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	MaxArchiveEntries = 1000
+	// MaxArchiveSize is total uncompressed bytes extracted from one archive
+	MaxArchiveSize = MaxBodySize
+	// MaxCompressionRatio rejects entries compressed suspiciously well
+	MaxCompressionRatio = 100
+)
+
+var (
+	ErrorArchive        = errors.New("file: not valid archive")
+	ErrorArchiveEntries = errors.New("file: too many archive entries")
+	ErrorArchiveSize    = errors.New("file: archive too large when extracted")
+	ErrorArchivePath    = errors.New("file: unsafe archive entry path")
+	ErrorArchiveRatio   = errors.New("file: archive entry compression ratio too high")
+)
+
+// NewImport makes Data to import archives of owner without a request
+func NewImport(owner bson.ObjectId) *Data {
+	return &Data{owner: owner}
+}
+
+// Extract makes Upload extract zip files and save each entry
+// instead of keeping zip as a single file
+func (d *Data) Extract() *Data {
+	d.extract = true
+	return d
+}
+
+// ImportZip saves every entry of zip archive as a file, results and
+// error follow Upload, result filenames are archive/entry
+func (d *Data) ImportZip(name string, r io.ReaderAt, size int64) (Results, error) {
+	d.begin()
+	d.importZip(name, r, size)
+	return d.results, d.first
+}
+
+func (d *Data) extractUpload(header *multipart.FileHeader) bool {
+	src, err := header.Open()
+	if err != nil {
+		return d.add(Result{Filename: header.Filename, Err: err})
+	}
+	defer src.Close()
+	return d.importZip(header.Filename, src, header.Size)
+}
+
+func (d *Data) importZip(name string, r io.ReaderAt, size int64) bool {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return d.add(Result{Filename: name, Err: ErrorArchive})
+	}
+	if len(z.File) > MaxArchiveEntries {
+		return d.add(Result{Filename: name, Err: ErrorArchiveEntries})
+	}
+	var extracted int64
+	for _, entry := range z.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		filename := path.Join(name, entry.Name)
+		content, err := readEntry(entry, MaxArchiveSize-extracted)
+		if err != nil {
+			if !d.add(Result{Filename: filename, Err: err}) {
+				return false
+			}
+			if err == ErrorArchiveSize {
+				return true
+			}
+			continue
+		}
+		extracted += int64(len(content))
+		file, err := d.store(entry.Name, int64(len(content)), bytes.NewReader(content))
+		if !d.add(Result{Filename: filename, File: file, Err: err}) {
+			return false
+		}
+	}
+	return true
+}
+
+// readEntry reads entry content without trusting sizes in its header
+func readEntry(entry *zip.File, remain int64) ([]byte, error) {
+	if !safeEntryPath(entry.Name) {
+		return nil, ErrorArchivePath
+	}
+	if _, ok := Format[extension(entry.Name)]; !ok {
+		return nil, ErrorBadFormat
+	}
+	if entry.UncompressedSize64 > uint64(MaxFileSize) {
+		return nil, ErrorTooLarge
+	}
+	if entry.CompressedSize64 > 0 &&
+		entry.UncompressedSize64/entry.CompressedSize64 > MaxCompressionRatio {
+		return nil, ErrorArchiveRatio
+	}
+	rc, err := entry.Open()
+	if err != nil {
+		return nil, ErrorArchive
+	}
+	defer rc.Close()
+	limit := MaxFileSize
+	if remain < limit {
+		limit = remain
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(rc, limit+1))
+	if err != nil {
+		return nil, ErrorArchive
+	}
+	if int64(len(content)) > limit {
+		if limit == remain {
+			return nil, ErrorArchiveSize
+		}
+		return nil, ErrorTooLarge
+	}
+	return content, nil
+}
+
+// safeEntryPath refuses absolute and parent references (zip slip),
+// entries are never written by their name but such archives are hostile
+func safeEntryPath(name string) bool {
+	if name == "" || strings.Contains(name, "\\") {
+		return false
+	}
+	if path.IsAbs(name) || filepath.IsAbs(name) {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteZip streams orginals of files into a zip archive
+func WriteZip(w io.Writer, files []File) error {
+	z := zip.NewWriter(w)
+	names := map[string]int{}
+	for _, f := range files {
+		name := f.Name
+		if n := names[name]; n > 0 {
+			name = fmt.Sprintf("%s_%d%s", f.NameNoExt(), n, f.Ext())
+		}
+		names[f.Name]++
+		if err := addToZip(z, name, f); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+func addToZip(z *zip.Writer, name string, f File) error {
+	src, err := os.Open(filepath.Join(config.ImagePath, f.Path))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: f.CreatedAt,
+	}
+	if f.Format == Image || f.Format == Video {
+		// already compressed formats
+		header.Method = zip.Store
+	}
+	dst, err := z.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// ServeZip writes files of owner with given ids as a zip download
+func ServeZip(w http.ResponseWriter, name string, owner bson.ObjectId, ids []bson.ObjectId) error {
+	files := []File{}
+	if err := db.Where(alive(bson.M{
+		"owner": owner,
+		"_id":   bson.M{"$in": ids},
+	})).Find(&files); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return ErrorNotValidFile
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", name+".zip"))
+	w.WriteHeader(http.StatusOK)
+	return WriteZip(w, files)
+}
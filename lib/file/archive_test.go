@@ -0,0 +1,99 @@
+package file
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadEntry(t *testing.T) {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	entries := map[string][]byte{
+		"images/ok.jpg":   []byte("jpeg content"),
+		"../../evil.jpg":  []byte("jpeg content"),
+		"/etc/passwd.jpg": []byte("jpeg content"),
+		"script.sh":       []byte("rm -rf /"),
+		"bomb.png":        make([]byte, 10*1024*1024),
+	}
+	for name, content := range entries {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(content)
+	}
+	w.Close()
+	z, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]error{
+		"images/ok.jpg":   nil,
+		"../../evil.jpg":  ErrorArchivePath,
+		"/etc/passwd.jpg": ErrorArchivePath,
+		"script.sh":       ErrorBadFormat,
+		"bomb.png":        ErrorArchiveRatio,
+	}
+	for _, entry := range z.File {
+		content, err := readEntry(entry, MaxArchiveSize)
+		if err != want[entry.Name] {
+			t.Errorf("%s: expected %v got %v", entry.Name, want[entry.Name], err)
+		}
+		if err == nil && !bytes.Equal(content, entries[entry.Name]) {
+			t.Errorf("%s: content mismatch", entry.Name)
+		}
+	}
+	for _, entry := range z.File {
+		if entry.Name != "images/ok.jpg" {
+			continue
+		}
+		if _, err := readEntry(entry, 4); err != ErrorArchiveSize {
+			t.Errorf("expected archive size limit got %v", err)
+		}
+	}
+}
+
+func TestWriteZip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config = &Config{ImagePath: dir}
+	files := []File{
+		{Name: "a.jpg", Path: "1/a.jpg", Format: Image},
+		{Name: "a.jpg", Path: "2/a.jpg", Format: Image},
+		{Name: "b.pdf", Path: "1/b.pdf", Format: Content},
+	}
+	for _, f := range files {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(f.Path)), 0777)
+		ioutil.WriteFile(filepath.Join(dir, f.Path), []byte(f.Path), 0644)
+	}
+	var b bytes.Buffer
+	if err := WriteZip(&b, files); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"a.jpg", "a_1.jpg", "b.pdf"}
+	if len(z.File) != len(names) {
+		t.Fatalf("expected %d entries got %d", len(names), len(z.File))
+	}
+	for i, entry := range z.File {
+		if entry.Name != names[i] {
+			t.Errorf("expected %s got %s", names[i], entry.Name)
+		}
+		rc, _ := entry.Open()
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if string(content) != files[i].Path {
+			t.Errorf("%s: unexpected content %s", entry.Name, content)
+		}
+	}
+}
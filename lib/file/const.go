@@ -4,15 +4,22 @@ const (
 	Video           = "video"
 	Image           = "image"
 	Content         = "content"
+	Vector          = "vector"
 	MaxFileSize     = int64(100 * 1000 * 1024)
 	MaxBodySize     = int64(100 * 1000 * 4096)
 	defaultImageExt = "jpg"
+	MicroSize       = "*w50h50"
+	ThumbSize       = "*w150h150"
+	MidSize         = "*w500h500"
+	BigSize         = "*w900h900"
 )
 
 var (
-	Format = map[string]string{
-		"jpeg": Image, "jpg": Image, "png": Image, "avi": Video,
-		"mkv": Video, "mp4": Video, "ogg": Video, "webm": Video,
+	DefaultPresets = []string{MicroSize, ThumbSize, MidSize, BigSize}
+	Format         = map[string]string{
+		"jpeg": Image, "jpg": Image, "png": Image, "gif": Image,
+		"svg": Vector, "avi": Video, "mkv": Video, "mp4": Video,
+		"ogg": Video, "webm": Video,
 		"doc": Content, "docx": Content, "xls": Content, "xlsx": Content,
 		"pdf": Content, "zip": Content, "tar.gz": Content,
 	}
@@ -0,0 +1,331 @@
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OpRotate     = "rotate"
+	OpFlip       = "flip"
+	OpCrop       = "crop"
+	OpBrightness = "brightness"
+	OpContrast   = "contrast"
+)
+
+var (
+	ErrorOperation = errors.New("file: not valid edit operation")
+
+	// path suffix form of operations like name*rot90*flipx*crop0_0_50_50*bri20*con-10.jpg
+	suffixOperations = []struct {
+		re    *regexp.Regexp
+		parse func(m []string) Operation
+	}{
+		{regexp.MustCompile(`^rot([0-9]+)$`), func(m []string) Operation {
+			return Operation{Op: OpRotate, Angle: atoi(m[1])}
+		}},
+		{regexp.MustCompile(`^flip([xy])$`), func(m []string) Operation {
+			return Operation{Op: OpFlip, Axis: m[1]}
+		}},
+		{regexp.MustCompile(`^crop([0-9]+)_([0-9]+)_([0-9]+)_([0-9]+)$`), func(m []string) Operation {
+			return Operation{Op: OpCrop,
+				X: atoi(m[1]), Y: atoi(m[2]), W: atoi(m[3]), H: atoi(m[4])}
+		}},
+		{regexp.MustCompile(`^bri(-?[0-9]+)$`), func(m []string) Operation {
+			return Operation{Op: OpBrightness, Value: atoi(m[1])}
+		}},
+		{regexp.MustCompile(`^con(-?[0-9]+)$`), func(m []string) Operation {
+			return Operation{Op: OpContrast, Value: atoi(m[1])}
+		}},
+	}
+)
+
+// Operation is an edit of image, Angle is 90, 180 or 270 clockwise,
+// Axis x mirrors horizontally and y vertically, crop uses X Y W H in
+// pixels of orginal and Value of brightness and contrast is -100..100
+type Operation struct {
+	Op    string `json:"op"`
+	Angle int    `json:"angle,omitempty"`
+	Axis  string `json:"axis,omitempty"`
+	X     int    `json:"x,omitempty"`
+	Y     int    `json:"y,omitempty"`
+	W     int    `json:"w,omitempty"`
+	H     int    `json:"h,omitempty"`
+	Value int    `json:"value,omitempty"`
+}
+
+func (op Operation) Valid() error {
+	switch op.Op {
+	case OpRotate:
+		if op.Angle == 90 || op.Angle == 180 || op.Angle == 270 {
+			return nil
+		}
+	case OpFlip:
+		if op.Axis == "x" || op.Axis == "y" {
+			return nil
+		}
+	case OpCrop:
+		if op.X >= 0 && op.Y >= 0 && op.W > 0 && op.H > 0 {
+			return nil
+		}
+	case OpBrightness, OpContrast:
+		if op.Value >= -100 && op.Value <= 100 {
+			return nil
+		}
+	}
+	return ErrorOperation
+}
+
+// Suffix is path form of operation
+func (op Operation) Suffix() string {
+	switch op.Op {
+	case OpRotate:
+		return fmt.Sprintf("*rot%d", op.Angle)
+	case OpFlip:
+		return "*flip" + op.Axis
+	case OpCrop:
+		return fmt.Sprintf("*crop%d_%d_%d_%d", op.X, op.Y, op.W, op.H)
+	case OpBrightness:
+		return fmt.Sprintf("*bri%d", op.Value)
+	case OpContrast:
+		return fmt.Sprintf("*con%d", op.Value)
+	}
+	return ""
+}
+
+// ParseOperations reads json list of operations
+func ParseOperations(data []byte) ([]Operation, error) {
+	ops := []Operation{}
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return nil, ErrorOperation
+	}
+	for _, op := range ops {
+		if err := op.Valid(); err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
+
+// getOperations parses operation suffixes of a derivative path,
+// segments which are not operations like sizes are skipped
+func getOperations(path string) ([]Operation, error) {
+	base := filepath.Base(path)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	ops := []Operation{}
+	for _, segment := range strings.Split(base, "*")[1:] {
+		for _, so := range suffixOperations {
+			m := so.re.FindStringSubmatch(segment)
+			if m == nil {
+				continue
+			}
+			op := so.parse(m)
+			if err := op.Valid(); err != nil {
+				return nil, err
+			}
+			ops = append(ops, op)
+			break
+		}
+	}
+	return ops, nil
+}
+
+// Edited is serving url of image with preset size like ThumbSize
+// after operations, empty preset keeps orginal size. Operations must
+// be listed in Config.Operations to be served
+func (f *File) Edited(preset string, ops ...Operation) string {
+	suffix := preset
+	for _, op := range ops {
+		suffix += op.Suffix()
+	}
+	if f.Format != Image {
+		return f.Orginal()
+	}
+	return f.sized(suffix)
+}
+
+// Edit applies operations on current content of image, it is stored
+// as a new version of f or as a new file of owner when asNew is set
+func (f *File) Edit(ops []Operation, asNew bool) (*File, error) {
+	if f.Trashed() {
+		return nil, ErrorTrashed
+	}
+	if f.Format != Image {
+		return nil, ErrorNotValidFile
+	}
+	if len(ops) == 0 {
+		return nil, ErrorOperation
+	}
+	for _, op := range ops {
+		if err := op.Valid(); err != nil {
+			return nil, err
+		}
+	}
+	orginal := filepath.Join(config.ImagePath, f.Path)
+	tmp := filepath.Join(filepath.Dir(orginal),
+		fmt.Sprintf(".%d-edit%s", time.Now().UnixNano(), f.Ext()))
+	defer os.Remove(tmp)
+	if err := resizer(orginal, tmp, 0, 0, ops...); err != nil {
+		return nil, err
+	}
+	src, err := os.Open(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	if asNew {
+		stat, err := src.Stat()
+		if err != nil {
+			return nil, err
+		}
+		d := NewImport(f.Owner)
+		d.begin()
+		return d.store(f.Name, stat.Size(), src)
+	}
+	if err := f.Replace(src); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// servedOperations reports whether operations of a derivative name may
+// be made for a visitor, every crop would be a new file on disk so
+// only suffixes of Config.Operations written as Suffix gives are
+func servedOperations(name string) bool {
+	ops, err := getOperations(name)
+	if err != nil {
+		return false
+	}
+	if len(ops) == 0 {
+		return true
+	}
+	suffix := ""
+	for _, op := range ops {
+		suffix += op.Suffix()
+	}
+	if !strings.Contains(name, suffix) {
+		return false
+	}
+	for _, allowed := range config.Operations {
+		if allowed == suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// applyOperations runs operations in order on img
+func applyOperations(img image.Image, ops []Operation) (image.Image, error) {
+	for _, op := range ops {
+		switch op.Op {
+		case OpRotate:
+			img = rotate(img, op.Angle)
+		case OpFlip:
+			img = flip(img, op.Axis)
+		case OpCrop:
+			rect := image.Rect(op.X, op.Y, op.X+op.W, op.Y+op.H).
+				Add(img.Bounds().Min).Intersect(img.Bounds())
+			if rect.Empty() {
+				return nil, ErrorOperation
+			}
+			m := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+			draw.Draw(m, m.Bounds(), img, rect.Min, draw.Src)
+			img = m
+		case OpBrightness, OpContrast:
+			img = adjust(img, op)
+		default:
+			return nil, ErrorOperation
+		}
+	}
+	return img, nil
+}
+
+func rotate(img image.Image, angle int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	var m *image.RGBA
+	if angle == 180 {
+		m = image.NewRGBA(image.Rect(0, 0, w, h))
+	} else {
+		m = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := img.At(b.Min.X+x, b.Min.Y+y)
+			switch angle {
+			case 90:
+				m.Set(h-1-y, x, c)
+			case 180:
+				m.Set(w-1-x, h-1-y, c)
+			case 270:
+				m.Set(y, w-1-x, c)
+			}
+		}
+	}
+	return m
+}
+
+func flip(img image.Image, axis string) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := img.At(b.Min.X+x, b.Min.Y+y)
+			if axis == "x" {
+				m.Set(w-1-x, y, c)
+			} else {
+				m.Set(x, h-1-y, c)
+			}
+		}
+	}
+	return m
+}
+
+func adjust(img image.Image, op Operation) image.Image {
+	b := img.Bounds()
+	m := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(m, m.Bounds(), img, b.Min, draw.Src)
+	var table [256]uint8
+	for i := range table {
+		v := float64(i)
+		if op.Op == OpBrightness {
+			v += float64(op.Value) * 255 / 100
+		} else {
+			c := float64(op.Value) * 2.55
+			factor := 259 * (c + 255) / (255 * (259 - c))
+			v = factor*(v-128) + 128
+		}
+		table[i] = clamp(v)
+	}
+	for i := 0; i < len(m.Pix); i += 4 {
+		m.Pix[i] = table[m.Pix[i]]
+		m.Pix[i+1] = table[m.Pix[i+1]]
+		m.Pix[i+2] = table[m.Pix[i+2]]
+	}
+	return m
+}
+
+func clamp(v float64) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
@@ -0,0 +1,147 @@
+package file
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	asyncBufferSize = 256
+)
+
+type EventType string
+
+const (
+	// Uploaded is emitted after a new file is stored
+	Uploaded EventType = "uploaded"
+	// DerivativeCreated is emitted after a size or poster is generated,
+	// Event.Path is the generated file on disk
+	DerivativeCreated EventType = "derivative_created"
+	// Deleted is emitted after a file is moved to trash
+	Deleted EventType = "deleted"
+	// Replaced is emitted after current version of a file changes
+	Replaced EventType = "replaced"
+)
+
+type Event struct {
+	Type EventType
+	File File
+	Path string
+	Time time.Time
+	// Previous is file before a Replaced event
+	Previous *File
+}
+
+// Subscriber receives file events, sync subscribers run on the goroutine
+// emitting the event so they must be fast
+type Subscriber interface {
+	Handle(e Event)
+}
+
+type SubscriberFunc func(e Event)
+
+func (fn SubscriberFunc) Handle(e Event) {
+	fn(e)
+}
+
+type subscription struct {
+	subscriber Subscriber
+	events     chan Event
+	done       chan struct{}
+	// mu guards closing events against a send of emit
+	mu     sync.RWMutex
+	closed bool
+}
+
+var (
+	subscriptions   = map[*subscription]bool{}
+	subscriptionsMu sync.RWMutex
+)
+
+// Subscribe calls s synchronously for every event, calling
+// unsubscribe stops delivery
+func Subscribe(s Subscriber) (unsubscribe func()) {
+	return subscribe(&subscription{subscriber: s})
+}
+
+// SubscribeAsync delivers events to s in order on its own goroutine,
+// events are dropped when s falls behind by more than a buffer
+func SubscribeAsync(s Subscriber) (unsubscribe func()) {
+	sub := &subscription{
+		subscriber: s,
+		events:     make(chan Event, asyncBufferSize),
+		done:       make(chan struct{}),
+	}
+	go func() {
+		defer close(sub.done)
+		for e := range sub.events {
+			sub.handle(e)
+		}
+	}()
+	return subscribe(sub)
+}
+
+func subscribe(sub *subscription) func() {
+	subscriptionsMu.Lock()
+	subscriptions[sub] = true
+	subscriptionsMu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			subscriptionsMu.Lock()
+			delete(subscriptions, sub)
+			subscriptionsMu.Unlock()
+			if sub.events != nil {
+				sub.mu.Lock()
+				sub.closed = true
+				close(sub.events)
+				sub.mu.Unlock()
+				<-sub.done
+			}
+		})
+	}
+}
+
+func (sub *subscription) handle(e Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("file: subscriber panic on", e.Type, r)
+		}
+	}()
+	sub.subscriber.Handle(e)
+}
+
+func emit(t EventType, f File, path string) {
+	publish(Event{Type: t, File: f, Path: path, Time: time.Now()})
+}
+
+func publish(e Event) {
+	// handlers run without the lock so they may subscribe or emit
+	subscriptionsMu.RLock()
+	subs := make([]*subscription, 0, len(subscriptions))
+	for sub := range subscriptions {
+		subs = append(subs, sub)
+	}
+	subscriptionsMu.RUnlock()
+	for _, sub := range subs {
+		if sub.events == nil {
+			sub.handle(e)
+			continue
+		}
+		sub.send(e)
+	}
+}
+
+func (sub *subscription) send(e Event) {
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+	if sub.closed {
+		return
+	}
+	select {
+	case sub.events <- e:
+	default:
+		log.Println("file: async subscriber is full, dropped", e.Type, e.File.Name)
+	}
+}
@@ -0,0 +1,66 @@
+package file
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	var sync []Event
+	unsubscribe := Subscribe(SubscriberFunc(func(e Event) {
+		sync = append(sync, e)
+	}))
+	async := make(chan Event, 10)
+	unsubscribeAsync := SubscribeAsync(SubscriberFunc(func(e Event) {
+		async <- e
+	}))
+	f := File{Name: "a.jpg"}
+	emit(Uploaded, f, "/a.jpg")
+	emit(Deleted, f, "/a.jpg")
+	unsubscribe()
+	unsubscribeAsync()
+	emit(Deleted, f, "/a.jpg")
+
+	if len(sync) != 2 || sync[0].Type != Uploaded || sync[1].Type != Deleted {
+		t.Errorf("unexpected sync events %v", sync)
+	}
+	close(async)
+	types := []EventType{}
+	for e := range async {
+		if e.File.Name != f.Name || e.Path != "/a.jpg" {
+			t.Errorf("unexpected payload %v", e)
+		}
+		types = append(types, e.Type)
+	}
+	if len(types) != 2 || types[0] != Uploaded || types[1] != Deleted {
+		t.Errorf("unexpected async events %v", types)
+	}
+}
+
+func TestSubscribeFromHandler(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		nested := 0
+		var unsubscribe func()
+		unsubscribe = Subscribe(SubscriberFunc(func(e Event) {
+			if e.Type != Uploaded {
+				nested++
+				return
+			}
+			inner := Subscribe(SubscriberFunc(func(Event) {}))
+			inner()
+			emit(Deleted, e.File, e.Path)
+		}))
+		emit(Uploaded, File{Name: "a.jpg"}, "/a.jpg")
+		unsubscribe()
+		done <- nested == 1
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("nested event is not delivered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler subscribing deadlocked")
+	}
+}
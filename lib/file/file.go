@@ -1,7 +1,6 @@
 package file
 
 import (
-	"errors"
 	"log"
 	"os"
 	"path/filepath"
@@ -12,15 +11,24 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
+// File is identified by CheckSum of its first upload, ContentSum is
+// checksum of current version after Replace and Parent is set on
+// files generated from another file like video posters
 type File struct {
-	ID        bson.ObjectId `bson:"_id,omitempty"`
-	Owner     bson.ObjectId `bson:"owner,omitempty"`
-	Name      string        `bson:"name"`
-	Path      string        `bson:"path"`
-	Format    string        `bson:"format"`
-	CheckSum  string        `bson:"check_sum"`
-	Keywords  []string      `bson:"keywords"`
-	CreatedAt time.Time     `bson:"created_at"`
+	ID         bson.ObjectId `bson:"_id,omitempty"`
+	Owner      bson.ObjectId `bson:"owner,omitempty"`
+	Name       string        `bson:"name"`
+	Path       string        `bson:"path"`
+	Format     string        `bson:"format"`
+	CheckSum   string        `bson:"check_sum"`
+	ContentSum string        `bson:"content_sum,omitempty"`
+	Version    int           `bson:"version,omitempty"`
+	Size       int64         `bson:"size"`
+	Keywords   []string      `bson:"keywords"`
+	CreatedAt  time.Time     `bson:"created_at"`
+	DeletedAt  time.Time     `bson:"deleted_at,omitempty"`
+	Parent     bson.ObjectId `bson:"parent,omitempty"`
+	Video      *VideoMeta    `bson:"video,omitempty"`
 }
 
 func (f *File) Ext() string {
@@ -32,47 +40,69 @@ func (f *File) NameNoExt() string {
 }
 
 func (f *File) Orginal() string {
-	return filepath.Join(config.ServingPrefix, f.Name)
+	return urlFor(f, f.Name)
 }
 
 func (f *File) Thumb() string {
-	if f.Format != Image {
-		return f.Orginal()
-	}
-	suffix := "*w150h150"
-	name := f.NameNoExt() + suffix + f.Ext()
-	return filepath.Join(config.ServingPrefix, name)
+	return f.sized(ThumbSize)
 }
 
 func (f *File) Micro() string {
-	if f.Format != Image {
-		return f.Orginal()
-	}
-	suffix := "*w50h50"
-	name := f.NameNoExt() + suffix + f.Ext()
-	return filepath.Join(config.ServingPrefix, name)
+	return f.sized(MicroSize)
 }
 
 func (f *File) Mid() string {
-	if f.Format != Image {
-		return f.Orginal()
-	}
-	suffix := "*w500h500"
-	name := f.NameNoExt() + suffix + f.Ext()
-	return filepath.Join(config.ServingPrefix, name)
+	return f.sized(MidSize)
 }
 
 func (f *File) Big() string {
-	if f.Format != Image {
-		return f.Orginal()
+	return f.sized(BigSize)
+}
+
+// sized returns serving url of image or video poster with size suffix
+func (f *File) sized(suffix string) string {
+	return urlFor(f, f.sizedName(suffix))
+}
+
+// sizedName is name of image or video poster with size suffix,
+// other formats have no sizes and give orginal name
+func (f *File) sizedName(suffix string) string {
+	name := f.Name
+	switch {
+	case f.Format == Image:
+	case f.Format == Video && f.hasPoster():
+		name = f.Video.PosterName
+	default:
+		return f.Name
 	}
-	suffix := "*w900h900"
-	name := f.NameNoExt() + suffix + f.Ext()
-	return filepath.Join(config.ServingPrefix, name)
+	ext := filepath.Ext(name)
+	return strings.Replace(name, ext, "", -1) + suffix + ext
 }
 
+func (f *File) hasPoster() bool {
+	return f.Video != nil && f.Video.PosterName != ""
+}
+
+// Rest of videos uses poster for sizes and vectors return orginal for all sizes
 func (f *File) Rest() map[string]interface{} {
-	if f.Format != Image {
+	if f.Format == Video && f.Video != nil {
+		res := map[string]interface{}{
+			"name":     f.NameNoExt(),
+			"original": f.Orginal(),
+			"duration": f.Video.Duration.Seconds(),
+			"width":    f.Video.Width,
+			"height":   f.Video.Height,
+		}
+		if f.hasPoster() {
+			res["poster"] = urlFor(f, f.Video.PosterName)
+			res["micro"] = f.Micro()
+			res["thumb"] = f.Thumb()
+			res["mid"] = f.Mid()
+			res["big"] = f.Big()
+		}
+		return res
+	}
+	if f.Format != Image && f.Format != Vector {
 		return map[string]interface{}{
 			"name":     f.NameNoExt(),
 			"original": f.Orginal(),
@@ -96,25 +126,37 @@ func (f *File) Save() error {
 		f.Owner.Hex(), f.Name, f.CheckSum,
 	}
 	duplicate := new(File)
-	if err := duplicate.Load(f.CheckSum, f.Owner); err == nil {
-		return errors.New("duplicate image entry")
+	if err := db.Where(bson.M{
+		"owner":     f.Owner,
+		"check_sum": f.CheckSum,
+	}).Find(duplicate); err == nil {
+		if !duplicate.Trashed() {
+			return ErrorDuplicate
+		}
+		// uploading the same content again brings it back from trash
+		*f = *duplicate
+		return f.Restore()
 	}
 	f.CreatedAt = time.Now()
-	return db.Create(f)
+	if err := db.Create(f); err != nil {
+		return err
+	}
+	enqueue(*f)
+	return nil
 }
 
 func (f *File) Load(checksum string, owner bson.ObjectId) error {
-	return db.Where(bson.M{
+	return db.Where(alive(bson.M{
 		"owner":     owner,
 		"check_sum": checksum,
-	}).Find(f)
+	})).Find(f)
 }
 
 func (f *File) LoadByName(owner bson.ObjectId, name string) error {
-	return db.Where(bson.M{
+	return db.Where(alive(bson.M{
 		"owner":     owner,
 		"check_sum": name,
-	}).Find(f)
+	})).Find(f)
 }
 
 func (File) Meta() []mgo.Index {
@@ -123,6 +165,7 @@ func (File) Meta() []mgo.Index {
 		{Key: []string{"owner", "check_sum"}},
 		{Key: []string{"created_at"}},
 		{Key: []string{"owner", "created_at"}},
+		{Key: []string{"deleted_at"}},
 	}
 }
 
@@ -147,11 +190,16 @@ func GetFile(owner bson.ObjectId, path string) string {
 		fullpath    string
 		orginalPath string
 	)
-	if err := db.Where(bson.M{
-		"check_sum": checksum, "owner": owner}).Find(file); err == nil {
+	if err := db.Where(alive(bson.M{
+		"check_sum": checksum, "owner": owner})).Find(file); err == nil {
 		fullpath = filepath.Join(config.ImagePath,
 			filepath.Dir(file.Path), base)
 		orginalPath = filepath.Join(config.ImagePath, file.Path)
+		countHit(file)
+		// content of replaced files is not stored by file name
+		if base == name {
+			return orginalPath
+		}
 	} else {
 		fullpath = filepath.Join(config.ImagePath, owner.Hex(), base)
 		orginalPath = filepath.Join(config.ImagePath, owner.Hex(), name)
@@ -160,22 +208,38 @@ func GetFile(owner bson.ObjectId, path string) string {
 	if _, err := os.Stat(fullpath); err == nil {
 		return fullpath
 	}
+	// vectors are served as is for every size
+	if Format[strings.TrimPrefix(filepath.Ext(name), ".")] == Vector {
+		return orginalPath
+	}
+	if !servedOperations(base) {
+		return fullpath
+	}
 	if err := makeFile(orginalPath, fullpath); err != nil {
 		log.Println(err)
+		return fullpath
 	}
+	if !file.ID.Valid() {
+		file.Owner = owner
+		file.Name = name
+	}
+	emit(DerivativeCreated, *file, fullpath)
 	return fullpath
 }
 
 func Count(owner bson.ObjectId) int {
-	count, _ := db.Where(bson.M{
-		"owner": owner,
-	}).Count(&File{})
+	count, _ := db.Where(alive(bson.M{
+		"owner":  owner,
+		"parent": bson.M{"$exists": false},
+	})).Count(&File{})
 	return count
 }
 
 func LoadFiles(owner bson.ObjectId, limit, page int) (files []File) {
-	db.Where(bson.M{"owner": owner}).
-		Sort("-created_at").Paginate(limit, page).Find(&files)
+	db.Where(alive(bson.M{
+		"owner":  owner,
+		"parent": bson.M{"$exists": false},
+	})).Sort("-created_at").Paginate(limit, page).Find(&files)
 	return files
 }
 
@@ -189,16 +253,26 @@ func LoadFilesForServe(owner bson.ObjectId, limit, page int) []map[string]interf
 }
 
 func Load(query bson.M, limit, page int) (files []File) {
-	db.Where(query).Sort("-created_at").Paginate(limit, page).Find(&files)
+	db.Where(alive(query)).Sort("-created_at").Paginate(limit, page).Find(&files)
 	return files
 }
 
+// Delete moves file to trash, it stays on disk until Purge or
+// the purge job removes it after retention days. Referenced files
+// are refused with ErrorInUse, see DeleteCascade
 func (f *File) Delete() error {
-	if err := db.Collection(f).Remove(bson.M{"id": f.ID}); err != nil {
+	if f.Trashed() {
+		return nil
+	}
+	if f.InUse() {
+		return ErrorInUse
+	}
+	f.DeletedAt = time.Now()
+	if err := db.Update(f); err != nil {
 		return err
 	}
-	path := filepath.Join(config.ImagePath, f.Path)
-	return os.Remove(path)
+	emit(Deleted, *f, filepath.Join(config.ImagePath, f.Path))
+	return nil
 }
 
 func getFileOrginalName(path string) string {
@@ -14,17 +14,17 @@ import (
 
 	"gopkg.in/mgo.v2/bson"
 
-	"github.com/jeyem/mogo"
+	"github.com/jeyem/gocommerce/util/repository"
 )
 
 var (
 	owner            = bson.ObjectIdHex("58237f6bd9d7db2827b9b392")
 	uploadableImages = []string{
-		"test-image/test.jpg",
-		"test-image/test2.jpg",
-		"test-image/test3.jpg",
-		"test-image/test4.jpg",
-		"test-image/test.png",
+		"test-images/test.jpg",
+		"test-images/test2.jpg",
+		"test-images/test3.jpg",
+		"test-images/test4.jpg",
+		"test-images/test.png",
 	}
 	shouldServe = []string{
 		"dae49be638e75b306cd116bfdb0632d5.jpg",
@@ -38,30 +38,29 @@ var (
 	}
 )
 
-func testPackageinit() {
-	cfg := new(Config)
-	cfg.ImagePath = "/tmp/test_images"
-	config = cfg
-	database, err := mogo.Conn("127.0.0.1:27017/test_images")
-	if err != nil {
-		log.Fatal(err)
-	}
-	db = database
+// testPackageinit registers a fresh repository storing in a temp directory
+func testPackageinit(t *testing.T) {
+	RegisterRepository(repository.NewMemory(), Config{ImagePath: t.TempDir()})
 }
 
 func TestUpload(t *testing.T) {
-	testPackageinit()
+	testPackageinit(t)
+	uploadTestImages(t)
+}
+
+func uploadTestImages(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(uploadImages))
 	defer ts.Close()
 	for _, image := range uploadableImages {
 		if err := upload(ts.URL, image); err != nil {
-			t.Error(err, "on jpeg")
+			t.Error(err, "on", image)
 		}
 	}
 }
 
 func TestServe(t *testing.T) {
-	testPackageinit()
+	testPackageinit(t)
+	uploadTestImages(t)
 	ts := httptest.NewServer(http.HandlerFunc(serveImages))
 	defer ts.Close()
 	for _, img := range shouldServe {
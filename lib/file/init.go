@@ -1,19 +1,51 @@
 package file
 
-import "github.com/jeyem/mogo"
+import (
+	"github.com/jeyem/gocommerce/util/repository"
+	"github.com/jeyem/mogo"
+)
 
 var (
-	db     *mogo.DB
-	config *Config
+	db          repository.Repository
+	config      *Config
+	unsubscribe func()
 )
 
 type Config struct {
 	ImagePath     string
 	ServingPrefix string
+	// TrashRetention is days a deleted file is kept before purge
+	TrashRetention int
+	// Quota is max bytes each owner can store, zero means unlimited
+	Quota int64
+	// StillGIF makes gif derivatives from first frame only
+	StillGIF bool
+	// Video makes posters and metadata for uploaded videos when set
+	Video VideoProber
+	// Queue pre generates derivatives of saved images when set
+	Queue *Queue
+	// URL builds public urls, ServingPrefix is joined with names when nil
+	URL URLBuilder
+	// Purger invalidates CDN cache of deleted and replaced files
+	Purger Purger
+	// Operations are edit suffixes like *rot90*flipx which GetFile
+	// makes for visitors, paths with other operations are not served
+	Operations []string
 }
 
 func Register(database *mogo.DB, conf Config) {
-	db = database
-	config = &conf
+	RegisterRepository(repository.NewMongo(database), conf)
+}
 
+// RegisterRepository is Register with any storage like repository.NewMemory
+func RegisterRepository(repo repository.Repository, conf Config) {
+	db = repo
+	config = &conf
+	if unsubscribe != nil {
+		unsubscribe()
+		unsubscribe = nil
+	}
+	if conf.Purger != nil {
+		unsubscribe = SubscribeAsync(purgeSubscriber{purger: conf.Purger})
+	}
 }
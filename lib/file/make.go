@@ -2,16 +2,20 @@ package file
 
 import (
 	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
+	"image/gif"
 	"image/jpeg"
-	_ "image/png"
+	"image/png"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nfnt/resize"
 )
@@ -25,11 +29,23 @@ func makeFile(orginal, want string) error {
 	if format != Image {
 		return errors.New("not an image to create resizer")
 	}
-	w, h := getSizes(want)
-	if w == 0 && h == 0 {
+	w, h := getSizes(filepath.Base(want))
+	ops, err := getOperations(want)
+	if err != nil {
+		return err
+	}
+	if w == 0 && h == 0 && len(ops) == 0 {
 		return errors.New("not valid sizes for resize")
 	}
-	return resizer(orginal, want, w, h)
+	// write aside and rename so concurrent makers of same size
+	// never serve a half written file
+	tmp := filepath.Join(filepath.Dir(want),
+		fmt.Sprintf(".%d-%s", time.Now().UnixNano(), filepath.Base(want)))
+	if err := resizer(orginal, tmp, w, h, ops...); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, want)
 }
 
 func getSizes(path string) (uint, uint) {
@@ -53,42 +69,129 @@ func getSizes(path string) (uint, uint) {
 	return w, h
 }
 
-func resizer(srcPath, destPath string, width, height uint) error {
-	var (
-		white      = color.RGBA{255, 255, 255, 255}
-		point      = image.Pt(0, 0)
-		imgW, imgH int
-	)
+// resizer applies edit operations on image then fits it in width and
+// height, zero width and height keeps size after operations
+func resizer(srcPath, destPath string, width, height uint, ops ...Operation) error {
 	src, err := os.Open(srcPath)
 	if err != nil {
 		return err
 	}
 	defer src.Close()
-	imgConfig, _, err := image.DecodeConfig(src)
+	if isGIF(srcPath) && isGIF(destPath) {
+		return gifResizer(src, destPath, width, height, ops)
+	}
+	img, _, err := image.Decode(src)
 	if err != nil {
 		return err
 	}
-	src.Seek(0, 0)
-	img, _, err := image.Decode(src)
+	m, err := transform(img, width, height, ops)
 	if err != nil {
 		return err
 	}
-	w, h := getValidWH(width, height, uint(imgConfig.Width), uint(imgConfig.Height))
-	imgResized := resize.Resize(w, h, img, resize.Bicubic)
 	dest, err := os.Create(destPath)
 	if err != nil {
 		return err
 	}
 	defer dest.Close()
+	switch strings.ToLower(filepath.Ext(destPath)) {
+	case ".gif":
+		return gif.Encode(dest, m, nil)
+	case ".png":
+		return png.Encode(dest, m)
+	}
+	return jpeg.Encode(dest, m, nil)
+}
+
+func transform(img image.Image, width, height uint, ops []Operation) (*image.RGBA, error) {
+	img, err := applyOperations(img, ops)
+	if err != nil {
+		return nil, err
+	}
+	if width == 0 && height == 0 {
+		width = uint(img.Bounds().Dx())
+	}
+	return fit(img, width, height), nil
+}
+
+// gifResizer resizes every frame of animated gif, with config.StillGIF
+// only first frame is kept
+func gifResizer(src io.Reader, destPath string, width, height uint, ops []Operation) error {
+	g, err := gif.DecodeAll(src)
+	if err != nil {
+		return err
+	}
+	if config.StillGIF && len(g.Image) > 1 {
+		g.Image = g.Image[:1]
+		g.Delay = g.Delay[:1]
+		if g.Disposal != nil {
+			g.Disposal = g.Disposal[:1]
+		}
+	}
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		bounds = g.Image[0].Bounds()
+	}
+	canvas := image.NewRGBA(bounds)
+	out := &gif.GIF{
+		Delay:     g.Delay,
+		LoopCount: g.LoopCount,
+	}
+	// frames may only cover part of canvas, compose each on previous
+	// ones respecting disposal then resize the full picture
+	for i, frame := range g.Image {
+		var previous *image.RGBA
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, bounds.Min, draw.Src)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		m, err := transform(canvas, width, height, ops)
+		if err != nil {
+			return err
+		}
+		p := image.NewPaletted(m.Bounds(), frame.Palette)
+		draw.FloydSteinberg.Draw(p, p.Bounds(), m, image.ZP)
+		out.Image = append(out.Image, p)
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	dest, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	return gif.EncodeAll(dest, out)
+}
+
+// fit resizes img into width x height on white background,
+// zero width or height keeps image ratio
+func fit(img image.Image, width, height uint) *image.RGBA {
+	var (
+		white      = color.RGBA{255, 255, 255, 255}
+		point      = image.Pt(0, 0)
+		imgW, imgH int
+	)
+	orginalW := img.Bounds().Dx()
+	orginalH := img.Bounds().Dy()
+	w, h := getValidWH(width, height, uint(orginalW), uint(orginalH))
+	imgResized := resize.Resize(w, h, img, resize.Bicubic)
 	imgW = int(width)
 	imgH = int(height)
 	if imgW == 0 {
-		ratio := float32(imgH) / float32(imgConfig.Height)
-		imgW = round(float32(imgConfig.Width) * ratio)
+		ratio := float32(imgH) / float32(orginalH)
+		imgW = round(float32(orginalW) * ratio)
 	}
 	if imgH == 0 {
-		ratio := float32(imgW) / float32(imgConfig.Width)
-		imgH = round(float32(imgConfig.Height) * ratio)
+		ratio := float32(imgW) / float32(orginalW)
+		imgH = round(float32(orginalH) * ratio)
 	}
 
 	m := image.NewRGBA(image.Rect(0, 0, imgW, imgH))
@@ -96,7 +199,7 @@ func resizer(srcPath, destPath string, width, height uint) error {
 	draw.Draw(m, b, &image.Uniform{white}, image.ZP, draw.Src)
 	// draw image center if resized image scaled ratio
 	if height != 0 && width != 0 {
-		if imgConfig.Width > imgConfig.Height {
+		if orginalW > orginalH {
 			y := int((height - h) / 2)
 			point = image.Pt(0, y)
 		} else {
@@ -105,8 +208,11 @@ func resizer(srcPath, destPath string, width, height uint) error {
 		}
 	}
 	draw.Draw(m, b, imgResized, b.Min.Sub(point), draw.Src)
+	return m
+}
 
-	return jpeg.Encode(dest, m, nil)
+func isGIF(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".gif"
 }
 
 func getValidWH(width, height, orginalW, orginalH uint) (uint, uint) {
@@ -0,0 +1,235 @@
+package file
+
+import (
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jeyem/gocommerce/util/repository"
+)
+
+func TestGIFResizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	anim := &gif.GIF{}
+	for _, c := range []color.Color{color.Black, color.White, color.Black} {
+		frame := image.NewPaletted(image.Rect(0, 0, 100, 50), palette.Plan9)
+		for x := 0; x < 100; x++ {
+			for y := 0; y < 50; y++ {
+				frame.Set(x, y, c)
+			}
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	orginal := filepath.Join(dir, "anim.gif")
+	f, err := os.Create(orginal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.EncodeAll(f, anim); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, still := range []bool{false, true} {
+		config = &Config{StillGIF: still}
+		want := filepath.Join(dir, "anim*w50.gif")
+		if err := makeFile(orginal, want); err != nil {
+			t.Fatal(err)
+		}
+		out, err := os.Open(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resized, err := gif.DecodeAll(out)
+		out.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames := 3
+		if still {
+			frames = 1
+		}
+		if len(resized.Image) != frames {
+			t.Errorf("still %v: expected %d frames got %d", still, frames, len(resized.Image))
+		}
+		if b := resized.Image[0].Bounds(); b.Dx() != 50 || b.Dy() != 25 {
+			t.Errorf("unexpected size %v", b)
+		}
+	}
+}
+
+func TestQueuePregenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config = &Config{ImagePath: dir}
+	f, err := os.Create(filepath.Join(dir, "image.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jpeg.Encode(f, image.NewRGBA(image.Rect(0, 0, 200, 100)), nil)
+	f.Close()
+
+	queue := NewQueue(2)
+	reports := 0
+	queue.Progress = func(p Progress) {
+		reports++
+		if p.Err != nil {
+			t.Error(p.Err)
+		}
+	}
+	queue.Start()
+	queue.Enqueue(File{Name: "image.jpg", Path: "image.jpg", Format: Image})
+	queue.Stop()
+	if done, failed, total := queue.Stats(); done != 1 || failed != 0 || total != 1 {
+		t.Errorf("unexpected stats %d %d %d", done, failed, total)
+	}
+	if reports != 1 {
+		t.Errorf("expected one progress got %d", reports)
+	}
+	for _, preset := range DefaultPresets {
+		if _, err := os.Stat(filepath.Join(dir, "image"+preset+".jpg")); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := queue.Enqueue(File{}); err != ErrorQueueClosed {
+		t.Errorf("expected closed queue got %v", err)
+	}
+}
+
+func TestOperations(t *testing.T) {
+	ops, err := getOperations("/data/abc*w100*rot90*flipx*crop0_0_20_10*bri20*con-10.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Operation{
+		{Op: OpRotate, Angle: 90},
+		{Op: OpFlip, Axis: "x"},
+		{Op: OpCrop, W: 20, H: 10},
+		{Op: OpBrightness, Value: 20},
+		{Op: OpContrast, Value: -10},
+	}
+	if len(ops) != len(want) {
+		t.Fatalf("expected %v got %v", want, ops)
+	}
+	suffix := ""
+	for i := range want {
+		if ops[i] != want[i] {
+			t.Errorf("expected %v got %v", want[i], ops[i])
+		}
+		suffix += ops[i].Suffix()
+	}
+	if suffix != "*rot90*flipx*crop0_0_20_10*bri20*con-10" {
+		t.Errorf("unexpected suffix %s", suffix)
+	}
+	if _, err := getOperations("abc*rot45.jpg"); err != ErrorOperation {
+		t.Errorf("expected invalid rotation got %v", err)
+	}
+	if _, err := ParseOperations([]byte(`[{"op":"flip","axis":"z"}]`)); err != ErrorOperation {
+		t.Errorf("expected invalid flip got %v", err)
+	}
+
+	// 40x20 image, left half black and right half white
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 20; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			img.Set(x, y, color.White)
+		}
+	}
+	rotated, err := applyOperations(img, []Operation{{Op: OpRotate, Angle: 90}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := rotated.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Errorf("unexpected rotated bounds %v", b)
+	}
+	if r, _, _, _ := rotated.At(0, 39).RGBA(); r != 0xffff {
+		t.Error("right half must be at bottom after rotate 90")
+	}
+	edited, err := applyOperations(img, []Operation{
+		{Op: OpFlip, Axis: "x"},
+		{Op: OpCrop, X: 0, Y: 0, W: 20, H: 20},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, _ := edited.At(10, 10).RGBA(); r != 0xffff || edited.Bounds().Dx() != 20 {
+		t.Error("flipped crop of left half must be white")
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	queue := &Queue{Workers: 1, jobs: make(chan File, 1)}
+	config = &Config{Queue: queue}
+	// saved images skip a queue which is not started
+	enqueue(File{Format: Image})
+	if _, _, total := queue.Stats(); total != 0 {
+		t.Error("not started queue got a job")
+	}
+	queue.started = true
+	enqueue(File{Format: Image})
+	if err := queue.Enqueue(File{Format: Image}); err != ErrorQueueFull {
+		t.Errorf("expected full queue got %v", err)
+	}
+	if _, _, total := queue.Stats(); total != 1 {
+		t.Errorf("unexpected total %d", total)
+	}
+}
+
+func TestServedOperations(t *testing.T) {
+	config = &Config{Operations: []string{"*rot90*flipx"}}
+	for name, served := range map[string]bool{
+		"abc*w150h150.jpg":             true,
+		"abc*w150h150*rot90*flipx.jpg": true,
+		"abc*rot90.jpg":                false,
+		"abc*rot090*flipx.jpg":         false,
+		"abc*crop0_0_10_10.jpg":        false,
+		"abc*rot45.jpg":                false,
+	} {
+		if servedOperations(name) != served {
+			t.Error(name, "expected served", served)
+		}
+	}
+}
+
+func TestEditAsNewQuota(t *testing.T) {
+	dir := t.TempDir()
+	RegisterRepository(repository.NewMemory(), Config{ImagePath: dir, Quota: 1000})
+	f, err := os.Create(filepath.Join(dir, "image.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, image.NewRGBA(image.Rect(0, 0, 20, 10)))
+	f.Close()
+	// quota is used up by orginal
+	orginal := &File{Owner: owner, Name: "image.png", Path: "image.png",
+		Format: Image, CheckSum: "image", Size: 1000}
+	if err := orginal.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orginal.Edit([]Operation{{Op: OpRotate, Angle: 90}}, true); err != ErrorQuota {
+		t.Error("edit as new file skipped quota", err)
+	}
+	if err := orginal.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	for _, asNew := range []bool{false, true} {
+		if _, err := orginal.Edit([]Operation{{Op: OpRotate, Angle: 90}}, asNew); err != ErrorTrashed {
+			t.Error("trashed file edited, as new", asNew, err)
+		}
+	}
+}
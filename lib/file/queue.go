@@ -0,0 +1,215 @@
+package file
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	defaultQueueSize = 1000
+	defaultRetries   = 3
+	defaultBackoff   = time.Second
+	backfillPage     = 100
+)
+
+var (
+	ErrorQueueClosed = errors.New("file: queue closed")
+	ErrorQueueFull   = errors.New("file: queue full")
+)
+
+// Progress is reported after every job of queue finishes
+type Progress struct {
+	File   File
+	Done   int
+	Failed int
+	Total  int
+	Err    error
+}
+
+// Queue pre generates derivatives of images in background,
+// set it as Config.Queue to enqueue every saved image
+type Queue struct {
+	Workers  int
+	Retries  int
+	Backoff  time.Duration
+	Presets  []string
+	Progress func(Progress)
+
+	jobs    chan File
+	wg      sync.WaitGroup
+	state   sync.RWMutex
+	started bool
+	closed  bool
+	mu      sync.Mutex
+	total   int
+	done    int
+	failed  int
+}
+
+func NewQueue(workers int) *Queue {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Queue{
+		Workers: workers,
+		Retries: defaultRetries,
+		Backoff: defaultBackoff,
+		Presets: DefaultPresets,
+		jobs:    make(chan File, defaultQueueSize),
+	}
+}
+
+func (q *Queue) Start() {
+	q.state.Lock()
+	q.started = true
+	q.state.Unlock()
+	for i := 0; i < q.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Stop waits for enqueued jobs to finish
+func (q *Queue) Stop() {
+	q.state.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.state.Unlock()
+	q.wg.Wait()
+}
+
+// Running reports whether queue is started and not stopped
+func (q *Queue) Running() bool {
+	q.state.RLock()
+	defer q.state.RUnlock()
+	return q.started && !q.closed
+}
+
+// Enqueue never blocks, it returns ErrorQueueFull when queue is full
+func (q *Queue) Enqueue(f File) error {
+	return q.push(f, false)
+}
+
+func (q *Queue) push(f File, wait bool) error {
+	q.state.RLock()
+	defer q.state.RUnlock()
+	if q.closed {
+		return ErrorQueueClosed
+	}
+	q.mu.Lock()
+	q.total++
+	q.mu.Unlock()
+	if wait {
+		q.jobs <- f
+		return nil
+	}
+	select {
+	case q.jobs <- f:
+		return nil
+	default:
+		q.mu.Lock()
+		q.total--
+		q.mu.Unlock()
+		return ErrorQueueFull
+	}
+}
+
+// enqueue offers a saved image to Config.Queue, images missed when
+// queue is full or not running are made on first serve by GetFile
+func enqueue(f File) {
+	q := config.Queue
+	if q == nil || f.Format != Image || !q.Running() {
+		return
+	}
+	if err := q.Enqueue(f); err != nil {
+		log.Println("file: enqueue", f.Name, err)
+	}
+}
+
+// Stats returns done, failed and total enqueued jobs
+func (q *Queue) Stats() (done, failed, total int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.done, q.failed, q.total
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for f := range q.jobs {
+		var err error
+		for attempt := 0; attempt <= q.Retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(q.Backoff * time.Duration(attempt))
+			}
+			if err = Pregenerate(&f, q.Presets...); err == nil {
+				break
+			}
+		}
+		q.mu.Lock()
+		if err != nil {
+			q.failed++
+		} else {
+			q.done++
+		}
+		progress := Progress{
+			File: f, Done: q.done, Failed: q.failed, Total: q.total, Err: err,
+		}
+		q.mu.Unlock()
+		if q.Progress != nil {
+			q.Progress(progress)
+		}
+	}
+}
+
+// Pregenerate makes missing derivatives of image for presets
+// like ThumbSize, all DefaultPresets when none given
+func Pregenerate(f *File, presets ...string) error {
+	if f.Format != Image {
+		return nil
+	}
+	if len(presets) == 0 {
+		presets = DefaultPresets
+	}
+	orginal := filepath.Join(config.ImagePath, f.Path)
+	for _, preset := range presets {
+		want := f.derivativePath(preset)
+		if _, err := os.Stat(want); err == nil {
+			continue
+		}
+		if err := makeFile(orginal, want); err != nil {
+			return err
+		}
+		emit(DerivativeCreated, *f, want)
+	}
+	return nil
+}
+
+// Backfill enqueues every stored image to queue waiting for free slots,
+// returns count of enqueued
+func Backfill(q *Queue) (int, error) {
+	count := 0
+	for page := 1; ; page++ {
+		files := []File{}
+		if err := db.Where(alive(bson.M{"format": Image})).
+			Sort("_id").Paginate(backfillPage, page).Find(&files); err != nil {
+			return count, err
+		}
+		if len(files) == 0 {
+			return count, nil
+		}
+		for _, f := range files {
+			if err := q.push(f, true); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+}
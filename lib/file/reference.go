@@ -0,0 +1,126 @@
+package file
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	ErrorInUse         = errors.New("file: still referenced")
+	ErrorUnknownEntity = errors.New("file: no cascade registered for entity")
+	ErrorTrashed       = errors.New("file: in trash")
+
+	cascades   = map[string]Cascade{}
+	cascadesMu sync.RWMutex
+)
+
+// Reference records that field of an entity points to a file
+type Reference struct {
+	ID        bson.ObjectId `bson:"_id,omitempty"`
+	File      bson.ObjectId `bson:"file"`
+	Entity    string        `bson:"entity"`
+	EntityID  bson.ObjectId `bson:"entity_id"`
+	Field     string        `bson:"field"`
+	CreatedAt time.Time     `bson:"created_at"`
+}
+
+func (Reference) Meta() []mgo.Index {
+	return []mgo.Index{
+		{Key: []string{"file"}},
+		{Key: []string{"entity", "entity_id"}},
+		{Key: []string{"file", "entity", "entity_id", "field"}, Unique: true},
+	}
+}
+
+// Cascade clears reference from its entity when a used file is
+// deleted with DeleteCascade
+type Cascade func(ref Reference) error
+
+// RegisterEntity declares an entity type which may reference files,
+// packages call it from init with a cascade that unsets the field
+func RegisterEntity(entity string, cascade Cascade) {
+	cascadesMu.Lock()
+	defer cascadesMu.Unlock()
+	cascades[entity] = cascade
+}
+
+// Use records that field of entity id references f, trashed files
+// are refused with ErrorTrashed
+func (f *File) Use(entity string, id bson.ObjectId, field string) error {
+	current := new(File)
+	if err := db.Get(current, f.ID); err != nil {
+		return err
+	}
+	if current.Trashed() {
+		return ErrorTrashed
+	}
+	ref := new(Reference)
+	query := bson.M{
+		"file": f.ID, "entity": entity, "entity_id": id, "field": field,
+	}
+	if err := db.Where(query).Find(ref); err == nil {
+		return nil
+	}
+	ref.File = f.ID
+	ref.Entity = entity
+	ref.EntityID = id
+	ref.Field = field
+	ref.CreatedAt = time.Now()
+	return db.Create(ref)
+}
+
+// Release removes reference of field of entity id to f
+func (f *File) Release(entity string, id bson.ObjectId, field string) error {
+	_, err := db.Remove(&Reference{}, bson.M{
+		"file": f.ID, "entity": entity, "entity_id": id, "field": field,
+	})
+	return err
+}
+
+// ReleaseEntity removes all file references of an entity, call it
+// when the entity itself is deleted
+func ReleaseEntity(entity string, id bson.ObjectId) error {
+	_, err := db.Remove(&Reference{}, bson.M{
+		"entity": entity, "entity_id": id,
+	})
+	return err
+}
+
+// Usages lists entities referencing f
+func (f *File) Usages() (refs []Reference, err error) {
+	err = db.Where(bson.M{"file": f.ID}).Sort("created_at").Find(&refs)
+	return refs, err
+}
+
+func (f *File) InUse() bool {
+	count, _ := db.Where(bson.M{"file": f.ID}).Count(&Reference{})
+	return count > 0
+}
+
+// DeleteCascade clears every reference through registered cascades
+// then deletes f, stops at first entity without cascade
+func (f *File) DeleteCascade() error {
+	refs, err := f.Usages()
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		cascadesMu.RLock()
+		cascade, ok := cascades[ref.Entity]
+		cascadesMu.RUnlock()
+		if !ok {
+			return ErrorUnknownEntity
+		}
+		if err := cascade(ref); err != nil {
+			return err
+		}
+		if _, err := db.Remove(&ref, bson.M{"_id": ref.ID}); err != nil {
+			return err
+		}
+	}
+	return f.Delete()
+}
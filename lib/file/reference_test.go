@@ -0,0 +1,110 @@
+package file
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func testFile(t *testing.T, name string) *File {
+	f := &File{Owner: owner, Name: name, Path: name, Format: Content, CheckSum: name}
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestReferences(t *testing.T) {
+	testPackageinit(t)
+	f := testFile(t, "a.pdf")
+	product := bson.NewObjectId()
+	if f.InUse() {
+		t.Fatal("new file is in use")
+	}
+	for i := 0; i < 2; i++ {
+		if err := f.Use("product", product, "manual"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Use("product", product, "cover"); err != nil {
+		t.Fatal(err)
+	}
+	refs, err := f.Usages()
+	if err != nil || len(refs) != 2 || refs[0].Field != "manual" {
+		t.Fatal("usages", refs, err)
+	}
+	if err := f.Delete(); err != ErrorInUse {
+		t.Error("used file deleted", err)
+	}
+	if err := f.Release("product", product, "manual"); err != nil {
+		t.Fatal(err)
+	}
+	if refs, _ := f.Usages(); len(refs) != 1 || refs[0].Field != "cover" {
+		t.Error("release", refs)
+	}
+	if err := ReleaseEntity("product", product); err != nil || f.InUse() {
+		t.Fatal("release entity", err)
+	}
+	if err := f.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Use("product", product, "cover"); err != ErrorTrashed {
+		t.Error("trashed file used", err)
+	}
+}
+
+func TestPurgeInUse(t *testing.T) {
+	testPackageinit(t)
+	f := testFile(t, "a.pdf")
+	if err := f.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	// a reference made before trash, like one of an older release
+	if err := db.Create(&Reference{File: f.ID, Entity: "product",
+		EntityID: bson.NewObjectId(), Field: "cover"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Purge(); err != ErrorInUse {
+		t.Error("used file purged", err)
+	}
+	if n, err := PurgeTrash(time.Now().Add(time.Second)); n != 0 || err != nil {
+		t.Error("purge trash of used file", n, err)
+	}
+	if CountTrash(owner) != 1 {
+		t.Error("used file is not kept")
+	}
+}
+
+func TestDeleteCascade(t *testing.T) {
+	testPackageinit(t)
+	f := testFile(t, "a.pdf")
+	cleared := []Reference{}
+	RegisterEntity("test_page", func(ref Reference) error {
+		cleared = append(cleared, ref)
+		return nil
+	})
+	page := bson.NewObjectId()
+	f.Use("test_page", page, "banner")
+	f.Use("test_unknown", page, "banner")
+	if err := f.DeleteCascade(); err != ErrorUnknownEntity {
+		t.Fatal("cascade with unknown entity", err)
+	}
+	if err := f.Release("test_unknown", page, "banner"); err != nil {
+		t.Fatal(err)
+	}
+	failing := errors.New("failed")
+	RegisterEntity("test_failing", func(ref Reference) error { return failing })
+	g := testFile(t, "b.pdf")
+	g.Use("test_failing", page, "banner")
+	if err := g.DeleteCascade(); err != failing || g.Trashed() {
+		t.Error("failed cascade deleted file", err)
+	}
+	if err := f.DeleteCascade(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cleared) != 1 || cleared[0].EntityID != page || f.InUse() || !f.Trashed() {
+		t.Error("cascade", cleared)
+	}
+}
@@ -0,0 +1,310 @@
+package file
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	ByOwner  = "owner"
+	ByFormat = "format"
+	ByMonth  = "month"
+
+	monthLayout = "200601"
+	reportPage  = 500
+)
+
+var (
+	monthDirectory = regexp.MustCompile(`^[0-9]{6}$`)
+
+	hits   = map[hitKey]int{}
+	hitsMu sync.Mutex
+)
+
+// Hit counts serves of a file and its sizes in a month
+type Hit struct {
+	ID    bson.ObjectId `bson:"_id,omitempty"`
+	File  bson.ObjectId `bson:"file"`
+	Owner bson.ObjectId `bson:"owner"`
+	Month string        `bson:"month"`
+	Count int           `bson:"count"`
+}
+
+func (Hit) Meta() []mgo.Index {
+	return []mgo.Index{
+		{Key: []string{"file", "month"}, Unique: true},
+		{Key: []string{"owner", "month"}},
+	}
+}
+
+type hitKey struct {
+	file  bson.ObjectId
+	owner bson.ObjectId
+	month string
+}
+
+// ReportRow is storage of a group, zero fields are not grouped by
+type ReportRow struct {
+	Owner  bson.ObjectId `json:"owner,omitempty"`
+	Format string        `json:"format,omitempty"`
+	Month  string        `json:"month,omitempty"`
+	Files  int           `json:"files"`
+	Size   int64         `json:"size"`
+}
+
+type ServedRow struct {
+	File File `json:"file"`
+	Hits int  `json:"hits"`
+}
+
+// countHit buffers a serve of f, FlushHits writes buffered counts
+func countHit(f *File) {
+	if !f.ID.Valid() {
+		return
+	}
+	key := hitKey{file: f.ID, owner: f.Owner, month: time.Now().Format(monthLayout)}
+	hitsMu.Lock()
+	hits[key]++
+	hitsMu.Unlock()
+}
+
+// FlushHits adds buffered serve counts to database
+func FlushHits() error {
+	hitsMu.Lock()
+	buffered := hits
+	hits = map[hitKey]int{}
+	hitsMu.Unlock()
+	for key, count := range buffered {
+		if err := db.Upsert(&Hit{}, bson.M{
+			"file": key.file, "month": key.month,
+		}, bson.M{
+			"$set": bson.M{"owner": key.owner},
+			"$inc": bson.M{"count": count},
+		}); err != nil {
+			// keep counts not written for next flush
+			hitsMu.Lock()
+			for key, count := range buffered {
+				hits[key] += count
+			}
+			hitsMu.Unlock()
+			return err
+		}
+		delete(buffered, key)
+	}
+	return nil
+}
+
+// StartHitFlusher calls FlushHits every interval, calling stop
+// flushes remaining hits and ends the job
+func StartHitFlusher(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := FlushHits(); err != nil {
+					log.Println("file: flush hits", err)
+				}
+			case <-done:
+				if err := FlushHits(); err != nil {
+					log.Println("file: flush hits", err)
+				}
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// StorageReport sums files matching query grouped by any of ByOwner,
+// ByFormat and ByMonth, trash is included as it still takes storage
+func StorageReport(query bson.M, by ...string) ([]ReportRow, error) {
+	groups := map[ReportRow]*ReportRow{}
+	for page := 1; ; page++ {
+		files := []File{}
+		if err := db.Where(query).Sort("_id").
+			Paginate(reportPage, page).Find(&files); err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			break
+		}
+		sizes, err := storedSizes(files)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			key := reportKey(&f, by)
+			row, ok := groups[key]
+			if !ok {
+				row = &ReportRow{Owner: key.Owner, Format: key.Format, Month: key.Month}
+				groups[key] = row
+			}
+			row.Files++
+			row.Size += sizes[f.ID]
+		}
+	}
+	rows := []ReportRow{}
+	for _, row := range groups {
+		rows = append(rows, *row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Owner != rows[j].Owner {
+			return rows[i].Owner < rows[j].Owner
+		}
+		if rows[i].Month != rows[j].Month {
+			return rows[i].Month < rows[j].Month
+		}
+		return rows[i].Format < rows[j].Format
+	})
+	return rows, nil
+}
+
+// storedSizes sums sizes of all versions of replaced files, other
+// files take their own size
+func storedSizes(files []File) (map[bson.ObjectId]int64, error) {
+	sizes := map[bson.ObjectId]int64{}
+	ids := []bson.ObjectId{}
+	for _, f := range files {
+		sizes[f.ID] = f.Size
+		if f.Version > 0 {
+			ids = append(ids, f.ID)
+			sizes[f.ID] = 0
+		}
+	}
+	if len(ids) == 0 {
+		return sizes, nil
+	}
+	versions := []Version{}
+	if err := db.Where(bson.M{"file": bson.M{"$in": ids}}).Find(&versions); err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		sizes[v.File] += v.Size
+	}
+	return sizes, nil
+}
+
+func reportKey(f *File, by []string) ReportRow {
+	key := ReportRow{}
+	for _, group := range by {
+		switch group {
+		case ByOwner:
+			key.Owner = f.Owner
+		case ByFormat:
+			key.Format = f.Format
+		case ByMonth:
+			key.Month = fileMonth(f)
+		}
+	}
+	return key
+}
+
+// fileMonth reads month from owner/200601/name path scheme
+func fileMonth(f *File) string {
+	parts := strings.Split(filepath.ToSlash(f.Path), "/")
+	if len(parts) == 3 && monthDirectory.MatchString(parts[1]) {
+		return parts[1]
+	}
+	return f.CreatedAt.Format(monthLayout)
+}
+
+// TopServed lists most served files, empty owner or month is not filtered
+func TopServed(owner bson.ObjectId, month string, limit int) ([]ServedRow, error) {
+	query := bson.M{}
+	if owner.Valid() {
+		query["owner"] = owner
+	}
+	if month != "" {
+		query["month"] = month
+	}
+	counted := []Hit{}
+	if err := db.Where(query).Find(&counted); err != nil {
+		return nil, err
+	}
+	totals := map[bson.ObjectId]int{}
+	for _, h := range counted {
+		totals[h.File] += h.Count
+	}
+	ids := make([]bson.ObjectId, 0, len(totals))
+	for id := range totals {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if totals[ids[i]] != totals[ids[j]] {
+			return totals[ids[i]] > totals[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	rows := []ServedRow{}
+	for _, id := range ids {
+		f := File{}
+		if err := db.Get(&f, id); err != nil {
+			continue
+		}
+		rows = append(rows, ServedRow{File: f, Hits: totals[id]})
+	}
+	return rows, nil
+}
+
+// WriteReportCSV writes rows with a header line
+func WriteReportCSV(w io.Writer, rows []ReportRow) error {
+	c := csv.NewWriter(w)
+	c.Write([]string{"owner", "format", "month", "files", "size"})
+	for _, row := range rows {
+		owner := ""
+		if row.Owner.Valid() {
+			owner = row.Owner.Hex()
+		}
+		c.Write([]string{
+			owner, row.Format, row.Month,
+			strconv.Itoa(row.Files), strconv.FormatInt(row.Size, 10),
+		})
+	}
+	c.Flush()
+	return c.Error()
+}
+
+func WriteReportJSON(w io.Writer, rows []ReportRow) error {
+	return json.NewEncoder(w).Encode(rows)
+}
+
+// WriteServedCSV writes most served rows with a header line
+func WriteServedCSV(w io.Writer, rows []ServedRow) error {
+	c := csv.NewWriter(w)
+	c.Write([]string{"file", "owner", "name", "format", "hits"})
+	for _, row := range rows {
+		c.Write([]string{
+			row.File.ID.Hex(), row.File.Owner.Hex(), row.File.Name,
+			row.File.Format, strconv.Itoa(row.Hits),
+		})
+	}
+	c.Flush()
+	return c.Error()
+}
+
+func WriteServedJSON(w io.Writer, rows []ServedRow) error {
+	return json.NewEncoder(w).Encode(rows)
+}
@@ -0,0 +1,109 @@
+package file
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jeyem/gocommerce/util/repository"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReportKey(t *testing.T) {
+	f := &File{
+		Owner:  owner,
+		Format: Image,
+		Path:   filepath.Join(owner.Hex(), "201802", "a.jpg"),
+	}
+	key := reportKey(f, []string{ByOwner, ByMonth})
+	if key.Owner != owner || key.Month != "201802" || key.Format != "" {
+		t.Errorf("unexpected key %v", key)
+	}
+	var b bytes.Buffer
+	WriteReportCSV(&b, []ReportRow{{Owner: owner, Month: "201802", Files: 2, Size: 10}})
+	want := "owner,format,month,files,size\n" + owner.Hex() + ",,201802,2,10\n"
+	if b.String() != want {
+		t.Errorf("unexpected csv %q", b.String())
+	}
+}
+
+func TestStorageReport(t *testing.T) {
+	testPackageinit(t)
+	a := storeTest(t, "a.pdf", "aaaa")
+	storeTest(t, "b.pdf", "bb")
+	other := &File{Owner: bson.NewObjectId(), Name: "c.jpg", Path: "c.jpg",
+		Format: Image, CheckSum: "c", Size: 10}
+	if err := other.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Replace(strings.NewReader("aaaaaa")); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := StorageReport(bson.M{"owner": owner}, ByOwner, ByFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both versions of a are stored
+	if len(rows) != 1 || rows[0].Files != 2 || rows[0].Size != 4+6+2 ||
+		rows[0].Format != Content {
+		t.Errorf("unexpected rows %v", rows)
+	}
+	rows, _ = StorageReport(bson.M{}, ByFormat)
+	if len(rows) != 2 || rows[0].Format != Content || rows[1].Size != 10 {
+		t.Errorf("unexpected rows by format %v", rows)
+	}
+}
+
+// failingUpserts fails Upsert after ok calls
+type failingUpserts struct {
+	repository.Repository
+	ok int
+}
+
+func (r *failingUpserts) Upsert(model interface{}, selector, update bson.M) error {
+	if r.ok == 0 {
+		return errors.New("upsert failed")
+	}
+	r.ok--
+	return r.Repository.Upsert(model, selector, update)
+}
+
+func TestFlushHits(t *testing.T) {
+	repo := &failingUpserts{Repository: repository.NewMemory(), ok: 1}
+	RegisterRepository(repo, Config{})
+	// hits served by other tests
+	hits = map[hitKey]int{}
+	a := &File{ID: bson.NewObjectId(), Owner: owner, Name: "a.jpg"}
+	b := &File{ID: bson.NewObjectId(), Owner: owner, Name: "b.jpg"}
+	for _, f := range []*File{a, a, a, b} {
+		countHit(f)
+	}
+	for _, f := range []*File{a, b} {
+		if err := db.Create(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := FlushHits(); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	repo.ok = 10
+	countHit(b)
+	if err := FlushHits(); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := TopServed(owner, "", 0)
+	if err != nil || len(rows) != 2 {
+		t.Fatal("top served", rows, err)
+	}
+	if rows[0].File.ID != a.ID || rows[0].Hits != 3 || rows[1].Hits != 2 {
+		t.Errorf("unexpected hits %v", rows)
+	}
+	if rows, _ := TopServed(owner, "190001", 0); len(rows) != 0 {
+		t.Errorf("hits of other month %v", rows)
+	}
+	if rows, _ := TopServed(owner, "", 1); len(rows) != 1 {
+		t.Errorf("limit is not applied %v", rows)
+	}
+}
@@ -0,0 +1,116 @@
+package file
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var (
+	// elements removed with all of their content
+	svgBannedElements = map[string]bool{
+		"script": true, "foreignobject": true, "iframe": true,
+		"embed": true, "object": true, "handler": true, "listener": true,
+	}
+	svgExternalStyle = regexp.MustCompile(
+		`(?i)@import|url\(\s*['"]?\s*([a-z][a-z0-9+.-]*:|//)`)
+	svgSafeData = regexp.MustCompile(`(?i)^data:image/(png|jpeg|jpg|gif);`)
+)
+
+// sanitizeSVG strips scripts, event handlers, external references
+// and doctype entities from svg document
+func sanitizeSVG(src io.Reader) ([]byte, error) {
+	var (
+		out     bytes.Buffer
+		skip    int
+		hasRoot bool
+		inStyle bool
+	)
+	d := xml.NewDecoder(src)
+	d.Strict = true
+	for {
+		token, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrorNotValidFile
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if skip > 0 || svgBannedElements[name] {
+				skip++
+				continue
+			}
+			if !hasRoot {
+				if name != "svg" {
+					return nil, ErrorNotValidFile
+				}
+				hasRoot = true
+			}
+			inStyle = name == "style"
+			out.WriteString("<" + qname(t.Name))
+			for _, attr := range t.Attr {
+				if !safeSVGAttr(attr) {
+					continue
+				}
+				out.WriteString(" " + qname(attr.Name) + `="`)
+				xml.EscapeText(&out, []byte(attr.Value))
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			inStyle = false
+			out.WriteString("</" + qname(t.Name) + ">")
+		case xml.CharData:
+			if skip > 0 || !hasRoot {
+				continue
+			}
+			if inStyle && svgExternalStyle.Match(t) {
+				continue
+			}
+			xml.EscapeText(&out, t)
+		case xml.ProcInst:
+			if t.Target == "xml" && !hasRoot {
+				out.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		}
+		// comments and directives (doctype, entities) are dropped
+	}
+	if !hasRoot {
+		return nil, ErrorNotValidFile
+	}
+	return out.Bytes(), nil
+}
+
+func safeSVGAttr(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	value := strings.ToLower(strings.Join(strings.Fields(attr.Value), ""))
+	if strings.HasPrefix(name, "on") {
+		return false
+	}
+	if strings.Contains(value, "javascript:") {
+		return false
+	}
+	if name == "href" || name == "src" {
+		return strings.HasPrefix(value, "#") || svgSafeData.MatchString(value)
+	}
+	if name == "style" && svgExternalStyle.MatchString(attr.Value) {
+		return false
+	}
+	return true
+}
+
+func qname(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
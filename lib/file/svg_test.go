@@ -0,0 +1,47 @@
+package file
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeSVG(t *testing.T) {
+	src := `<?xml version="1.0"?>
+<!DOCTYPE svg [<!ENTITY x "y">]>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" onload="alert(1)">
+<script>alert(1)</script>
+<style>@import url(http://evil.com/a.css);</style>
+<foreignObject><div>html</div></foreignObject>
+<use xlink:href="#logo"/>
+<image href="http://evil.com/track.png" width="10"/>
+<a href=" java script:alert(1)"><rect id="logo" width="10" height="10" style="fill:red"/></a>
+</svg>`
+	out, err := sanitizeSVG(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clean := string(out)
+	for _, bad := range []string{
+		"script", "onload", "@import", "foreignObject", "evil.com", "ENTITY",
+	} {
+		if strings.Contains(clean, bad) {
+			t.Errorf("%q left in %s", bad, clean)
+		}
+	}
+	for _, good := range []string{
+		`xlink:href="#logo"`, `xmlns:xlink=`, `style="fill:red"`, `<rect id="logo"`,
+	} {
+		if !strings.Contains(clean, good) {
+			t.Errorf("%q removed from %s", good, clean)
+		}
+	}
+}
+
+func TestSanitizeSVGNotSVG(t *testing.T) {
+	if _, err := sanitizeSVG(strings.NewReader("<html></html>")); err != ErrorNotValidFile {
+		t.Errorf("expected not valid got %v", err)
+	}
+	if _, err := sanitizeSVG(strings.NewReader("not xml")); err != ErrorNotValidFile {
+		t.Errorf("expected not valid got %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package file
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	defaultTrashRetention = 30
+	purgeBatchSize        = 100
+)
+
+var (
+	ErrorNotTrashed = errors.New("file: not in trash")
+)
+
+// Trashed reports whether file is soft deleted
+func (f *File) Trashed() bool {
+	return !f.DeletedAt.IsZero()
+}
+
+// Restore brings back soft deleted file from trash
+func (f *File) Restore() error {
+	if !f.Trashed() {
+		return ErrorNotTrashed
+	}
+	f.DeletedAt = time.Time{}
+	return db.Update(f)
+}
+
+// Purge removes orginal, all derivatives and file record permanently,
+// record is removed last so a failed purge can be tried again.
+// Referenced files are refused with ErrorInUse
+func (f *File) Purge() error {
+	if f.InUse() {
+		return ErrorInUse
+	}
+	if f.Video != nil && f.Video.Poster.Valid() {
+		poster := new(File)
+		if err := db.Get(poster, f.Video.Poster); err == nil &&
+			poster.Parent == f.ID {
+			if err := poster.Purge(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := removeFromDisk(f); err != nil {
+		return err
+	}
+	_, err := db.Remove(f, bson.M{"_id": f.ID})
+	return err
+}
+
+// LoadTrashed loads a soft deleted file by id
+func (f *File) LoadTrashed(owner, id bson.ObjectId) error {
+	return db.Where(trashed(bson.M{
+		"_id":   id,
+		"owner": owner,
+	})).Find(f)
+}
+
+func LoadTrash(owner bson.ObjectId, limit, page int) (files []File) {
+	db.Where(trashed(bson.M{"owner": owner})).
+		Sort("-deleted_at").Paginate(limit, page).Find(&files)
+	return files
+}
+
+func CountTrash(owner bson.ObjectId) int {
+	count, _ := db.Where(trashed(bson.M{
+		"owner": owner,
+	})).Count(&File{})
+	return count
+}
+
+// PurgeTrash permanently removes files deleted before given time, files
+// still in use are skipped and files failing to purge are logged and
+// skipped, first of their errors is returned
+func PurgeTrash(before time.Time) (int, error) {
+	purged := 0
+	skipped := []bson.ObjectId{}
+	var first error
+	for {
+		query := bson.M{"deleted_at": bson.M{"$lt": before}}
+		if len(skipped) > 0 {
+			query["_id"] = bson.M{"$nin": skipped}
+		}
+		files := []File{}
+		if err := db.Where(query).Sort("deleted_at").
+			Paginate(purgeBatchSize, 1).Find(&files); err != nil {
+			return purged, err
+		}
+		if len(files) == 0 {
+			return purged, first
+		}
+		for _, f := range files {
+			if err := f.Purge(); err != nil {
+				skipped = append(skipped, f.ID)
+				if err == ErrorInUse {
+					continue
+				}
+				log.Println("file: purge", f.Path, err)
+				if first == nil {
+					first = err
+				}
+				continue
+			}
+			purged++
+		}
+	}
+}
+
+// StartPurgeJob runs PurgeTrash every interval for files older than
+// config.TrashRetention days, calling stop ends the job
+func StartPurgeJob(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				before := time.Now().AddDate(0, 0, -trashRetention())
+				if n, err := PurgeTrash(before); err != nil {
+					log.Println("file: purge trash", err)
+				} else if n > 0 {
+					log.Println("file: purged", n, "files from trash")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func trashRetention() int {
+	if config.TrashRetention > 0 {
+		return config.TrashRetention
+	}
+	return defaultTrashRetention
+}
+
+func removeFromDisk(f *File) error {
+	versions, err := f.Versions()
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		content := *f
+		content.Path = v.Path
+		paths := derivatives(content.derivativeBase())
+		if !sharedPath(f, v.Path) {
+			paths = append(paths, filepath.Join(config.ImagePath, v.Path))
+		}
+		for _, path := range paths {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	_, err = db.Remove(&Version{}, bson.M{"file": f.ID})
+	return err
+}
+
+// sharedPath reports whether content at path belongs to another file
+// too, older releases stored replaced content by checksum only
+func sharedPath(f *File, path string) bool {
+	files, _ := db.Where(bson.M{
+		"path": path, "_id": bson.M{"$ne": f.ID},
+	}).Count(&File{})
+	versions, _ := db.Where(bson.M{
+		"path": path, "file": bson.M{"$ne": f.ID},
+	}).Count(&Version{})
+	return files > 0 || versions > 0
+}
+
+// derivatives lists generated sizes of orginal like checksum*w150h150.jpg
+func derivatives(orginal string) (paths []string) {
+	dir := filepath.Dir(orginal)
+	base := filepath.Base(orginal)
+	prefix := strings.Replace(base, filepath.Ext(base), "", -1) + "*"
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), prefix) {
+			paths = append(paths, filepath.Join(dir, info.Name()))
+		}
+	}
+	return paths
+}
+
+// alive excludes soft deleted files from query
+func alive(query bson.M) bson.M {
+	q := bson.M{"deleted_at": bson.M{"$exists": false}}
+	for k, v := range query {
+		q[k] = v
+	}
+	return q
+}
+
+func trashed(query bson.M) bson.M {
+	q := bson.M{"deleted_at": bson.M{"$exists": true}}
+	for k, v := range query {
+		q[k] = v
+	}
+	return q
+}
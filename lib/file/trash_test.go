@@ -0,0 +1,110 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jeyem/gocommerce/util/repository"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDerivatives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "derivatives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	names := []string{
+		"dae49be638e75b306cd116bfdb0632d5.jpg",
+		"dae49be638e75b306cd116bfdb0632d5*w250h250.jpg",
+		"dae49be638e75b306cd116bfdb0632d5*h700.jpg",
+		"f00a78e13abe880ecdaedbbf5499cb77*w250h250.jpg",
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths := derivatives(filepath.Join(dir, names[0]))
+	sort.Strings(paths)
+	want := []string{
+		filepath.Join(dir, names[2]),
+		filepath.Join(dir, names[1]),
+	}
+	if len(paths) != len(want) {
+		t.Fatalf("got %v want %v", paths, want)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Errorf("got %s want %s", paths[i], want[i])
+		}
+	}
+}
+
+func TestTrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	RegisterRepository(repository.NewMemory(), Config{ImagePath: dir})
+	owner := bson.NewObjectId()
+	f := &File{Owner: owner, Name: "a.txt", Path: owner.Hex() + "/a.txt",
+		Format: Content, CheckSum: "a"}
+	os.MkdirAll(filepath.Join(dir, owner.Hex()), 0755)
+	ioutil.WriteFile(filepath.Join(dir, f.Path), []byte("a"), 0644)
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if Count(owner) != 0 || CountTrash(owner) != 1 {
+		t.Fatal("deleted file is not in trash")
+	}
+	again := &File{Owner: owner, Name: "a.txt", CheckSum: "a"}
+	if err := again.Save(); err != nil || again.ID != f.ID || again.Trashed() {
+		t.Fatal("upload of trashed content is not restored", err)
+	}
+	if err := again.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	purged, err := PurgeTrash(time.Now().Add(time.Second))
+	if err != nil || purged != 1 {
+		t.Fatal("purged", purged, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, f.Path)); !os.IsNotExist(err) {
+		t.Error("purged file is still on disk")
+	}
+	if CountTrash(owner) != 0 {
+		t.Error("purged file is still in trash")
+	}
+}
+
+func TestPurgeTrashSkipsFailures(t *testing.T) {
+	dir := t.TempDir()
+	RegisterRepository(repository.NewMemory(), Config{ImagePath: dir})
+	owner := bson.NewObjectId()
+	os.MkdirAll(filepath.Join(dir, owner.Hex(), "bad.txt", "inside"), 0755)
+	for _, name := range []string{"bad.txt", "good.txt"} {
+		f := &File{Owner: owner, Name: name, Path: filepath.Join(owner.Hex(), name),
+			Format: Content, CheckSum: name}
+		if err := f.Save(); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Delete(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	purged, err := PurgeTrash(time.Now().Add(time.Second))
+	if err == nil || purged != 1 {
+		t.Fatal("purged", purged, err)
+	}
+	if CountTrash(owner) != 1 {
+		t.Error("failed file is not kept in trash")
+	}
+}
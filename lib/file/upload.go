@@ -1,6 +1,7 @@
 package file
 
 import (
+	"bytes"
 	"crypto/md5"
 	"errors"
 	"fmt"
@@ -18,13 +19,67 @@ import (
 
 var (
 	ErrorNotValidFile = errors.New("file: not valid")
+	ErrorTooLarge     = errors.New("file: too large")
+	ErrorBadFormat    = errors.New("file: format not supported")
+	ErrorDuplicate    = errors.New("file: duplicate entry")
+	ErrorQuota        = errors.New("file: storage quota exceeded")
+	ErrorNoField      = errors.New("file: upload field not found")
 )
 
+// Error is a failure of a single file in an upload batch
+type Error struct {
+	Filename string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return e.Filename + " " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Result is outcome of a single uploaded file, File is set on success
+// and Err is one of the Error* values or an io/db error on failure
+type Result struct {
+	Filename string
+	File     *File
+	Err      error
+}
+
+type Results []Result
+
+// Files returns successfully saved files
+func (rs Results) Files() (files []File) {
+	for _, r := range rs {
+		if r.Err == nil && r.File != nil {
+			files = append(files, *r.File)
+		}
+	}
+	return files
+}
+
+// Failed returns results with errors
+func (rs Results) Failed() (failed Results) {
+	for _, r := range rs {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
 type Data struct {
-	req   *http.Request
-	field string
-	owner bson.ObjectId
-	files []File
+	req         *http.Request
+	field       string
+	owner       bson.ObjectId
+	transaction bool
+	extract     bool
+	usage       int64
+	started     time.Time
+	first       error
+	results     Results
 }
 
 func New(r *http.Request, field string, owner bson.ObjectId) *Data {
@@ -35,40 +90,142 @@ func New(r *http.Request, field string, owner bson.ObjectId) *Data {
 	}
 }
 
-func (d *Data) Upload() ([]File, error) {
+// Transaction makes upload all-or-nothing, on any failure
+// already saved files of the batch are rolled back
+func (d *Data) Transaction() *Data {
+	d.transaction = true
+	return d
+}
+
+// Upload saves every file of the field and returns a result per file.
+// Returned error is the request level error or first failed file as *Error,
+// in transaction mode no file of results is kept when error is not nil.
+func (d *Data) Upload() (Results, error) {
 	if err := d.req.ParseMultipartForm(MaxBodySize); err != nil {
 		return nil, err
 	}
 	mpf := d.req.MultipartForm
 	fileHeaders, ok := mpf.File[d.field]
 	if !ok {
-		return d.files, errors.New("upload field not found")
+		return d.results, ErrorNoField
 	}
+	d.begin()
 	for _, header := range fileHeaders {
-		if err := d.getInput(header); err != nil {
-			return d.files, errors.New(header.Filename + " " + err.Error())
+		if d.extract && extension(header.Filename) == "zip" {
+			if !d.extractUpload(header) {
+				return d.results, d.first
+			}
+			continue
+		}
+		file, err := d.getInput(header)
+		if !d.add(Result{Filename: header.Filename, File: file, Err: err}) {
+			return d.results, d.first
 		}
 	}
-	return d.files, nil
+	return d.results, d.first
 }
 
-func (d *Data) getInput(f *multipart.FileHeader) error {
+func (d *Data) begin() {
+	d.started = time.Now()
+	if config.Quota > 0 {
+		d.usage = Usage(d.owner)
+	}
+}
+
+// add collects result, returns false when batch must stop
+func (d *Data) add(r Result) bool {
+	d.results = append(d.results, r)
+	if r.Err == nil {
+		return true
+	}
+	if d.first == nil {
+		d.first = &Error{Filename: r.Filename, Err: r.Err}
+	}
+	if d.transaction {
+		d.rollback()
+		return false
+	}
+	return true
+}
+
+func (d *Data) rollback() {
+	for i, r := range d.results {
+		if r.File == nil {
+			continue
+		}
+		var err error
+		// files restored from trash in this batch go back to trash
+		if r.File.CreatedAt.Before(d.started) {
+			err = r.File.Delete()
+		} else {
+			err = r.File.Purge()
+		}
+		if err != nil {
+			log.Println("file: rollback", r.Filename, err)
+		}
+		d.results[i].File = nil
+		if d.results[i].Err == nil {
+			d.results[i].Err = errors.New("file: rolled back")
+		}
+	}
+}
+
+func (d *Data) getInput(f *multipart.FileHeader) (*File, error) {
 	if f.Size > MaxFileSize {
-		return ErrorNotValidFile
+		return nil, ErrorTooLarge
 	}
-	f.Filename = strings.ToLower(f.Filename)
-	ext := filepath.Ext(f.Filename)
-	ext = strings.Replace(ext, ".", "", -1)
-	format, ok := Format[ext]
-	if !ok {
-		return ErrorNotValidFile
+	if _, ok := Format[extension(f.Filename)]; !ok {
+		return nil, ErrorBadFormat
 	}
 	src, err := f.Open()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer src.Close()
-	checksum := getMD5Checksum(src)
+	return d.store(f.Filename, f.Size, src)
+}
+
+// store validates and saves content of src as a file of owner
+func (d *Data) store(name string, size int64, src io.ReadSeeker) (*File, error) {
+	if size > MaxFileSize {
+		return nil, ErrorTooLarge
+	}
+	ext := extension(name)
+	format, ok := Format[ext]
+	if !ok {
+		return nil, ErrorBadFormat
+	}
+	body := src
+	if format == Vector {
+		clean, err := sanitizeSVG(src)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(clean)
+		size = int64(len(clean))
+	}
+	checksum, err := getMD5Checksum(body)
+	if err != nil {
+		return nil, err
+	}
+	duplicate := new(File)
+	if err := db.Where(bson.M{
+		"owner": d.owner, "check_sum": checksum,
+	}).Find(duplicate); err == nil && !duplicate.Trashed() {
+		return nil, ErrorDuplicate
+	}
+	if duplicate.ID.Valid() {
+		// uploading trashed content brings it back, it is already on
+		// disk and in usage
+		if err := duplicate.Restore(); err != nil {
+			return nil, err
+		}
+		emit(Uploaded, *duplicate, filepath.Join(config.ImagePath, duplicate.Path))
+		return duplicate, nil
+	}
+	if config.Quota > 0 && d.usage+size > config.Quota {
+		return nil, ErrorQuota
+	}
 	subDirectory := filepath.Join(d.owner.Hex(), time.Now().Format("200601"))
 	filename := checksum + "." + ext
 	path := filepath.Join(subDirectory, filename)
@@ -77,31 +234,67 @@ func (d *Data) getInput(f *multipart.FileHeader) error {
 		os.MkdirAll(fullDirectoryPath, 0777)
 	}
 	fullPath := filepath.Join(config.ImagePath, path)
-	src.Seek(0, 0)
+	body.Seek(0, 0)
 	dst, err := os.Create(fullPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer dst.Close()
-	io.Copy(dst, src)
-	file := File{
+	if _, err := io.Copy(dst, body); err != nil {
+		os.Remove(fullPath)
+		return nil, err
+	}
+	file := &File{
 		Owner:    d.owner,
 		Name:     filename,
 		Path:     path,
 		Format:   format,
 		CheckSum: checksum,
+		Size:     size,
+	}
+	if err := file.Save(); err != nil {
+		os.Remove(fullPath)
+		return nil, err
+	}
+	d.usage += size
+	if err := ProcessVideo(file); err != nil {
+		log.Println("file: video", file.Name, err)
+	}
+	emit(Uploaded, *file, filepath.Join(config.ImagePath, file.Path))
+	return file, nil
+}
+
+// extension is lower case extension without dot, knows tar.gz
+func extension(name string) string {
+	name = strings.ToLower(name)
+	if strings.HasSuffix(name, ".tar.gz") {
+		return "tar.gz"
+	}
+	return strings.TrimPrefix(filepath.Ext(name), ".")
+}
+
+// Usage is total bytes stored by owner, including trash
+func Usage(owner bson.ObjectId) (size int64) {
+	files := []File{}
+	db.Where(bson.M{"owner": owner}).Find(&files)
+	// versions of replaced files are stored too
+	sizes, err := storedSizes(files)
+	if err != nil {
+		for _, f := range files {
+			size += f.Size
+		}
+		return size
 	}
-	if file.Save(); err != nil {
-		return err
+	for _, s := range sizes {
+		size += s
 	}
-	d.files = append(d.files, file)
-	return nil
+	return size
 }
 
-func getMD5Checksum(f io.Reader) string {
+func getMD5Checksum(f io.Reader) (string, error) {
 	h := md5.New()
 	if _, err := io.Copy(h, f); err != nil {
-		log.Fatal(err)
+		return "", err
 	}
-	return fmt.Sprintf("%x", h.Sum(nil))
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
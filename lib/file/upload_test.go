@@ -0,0 +1,105 @@
+package file
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jeyem/gocommerce/util/repository"
+)
+
+// uploadRequest makes multipart request of name and content pairs
+func uploadRequest(t *testing.T, files ...string) *http.Request {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	for i := 0; i < len(files); i += 2 {
+		fw, err := w.CreateFormFile("file", files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(files[i+1]))
+	}
+	w.Close()
+	req, err := http.NewRequest("POST", "/", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
+
+func TestUploadResults(t *testing.T) {
+	testPackageinit(t)
+	req := uploadRequest(t, "setup.exe", "content", "archive.rar", "content")
+	results, err := New(req, "file", owner).Upload()
+	fileErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expected *Error got %v", err)
+	}
+	if fileErr.Filename != "setup.exe" || fileErr.Err != ErrorBadFormat {
+		t.Errorf("unexpected error %v", fileErr)
+	}
+	if !errors.Is(err, ErrorBadFormat) {
+		t.Error("error does not unwrap")
+	}
+	if len(results) != 2 || len(results.Failed()) != 2 {
+		t.Fatalf("expected two failed results got %v", results)
+	}
+	if len(results.Files()) != 0 {
+		t.Errorf("expected no saved files")
+	}
+}
+
+func TestUploadTransaction(t *testing.T) {
+	testPackageinit(t)
+	req := uploadRequest(t, "a.pdf", "a", "b.pdf", "b", "c.exe", "c")
+	results, err := New(req, "file", owner).Transaction().Upload()
+	if !errors.Is(err, ErrorBadFormat) {
+		t.Fatal("expected bad format got", err)
+	}
+	if len(results.Files()) != 0 || Count(owner) != 0 || Usage(owner) != 0 {
+		t.Error("saved files are not rolled back", results)
+	}
+}
+
+func TestUploadDuplicate(t *testing.T) {
+	testPackageinit(t)
+	req := uploadRequest(t, "a.pdf", "same", "b.pdf", "same")
+	results, err := New(req, "file", owner).Upload()
+	if !errors.Is(err, ErrorDuplicate) {
+		t.Fatal("expected duplicate got", err)
+	}
+	if len(results.Files()) != 1 || results[1].Err != ErrorDuplicate {
+		t.Error("unexpected results", results)
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	RegisterRepository(repository.NewMemory(), Config{ImagePath: t.TempDir(), Quota: 4})
+	results, err := New(uploadRequest(t, "a.pdf", "aaaa", "b.pdf", "b"), "file", owner).Upload()
+	if !errors.Is(err, ErrorQuota) || len(results.Files()) != 1 {
+		t.Fatal("expected quota error got", err)
+	}
+	f := results.Files()[0]
+	if err := f.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	// restoring trashed content takes no more storage
+	results, err = New(uploadRequest(t, "a.pdf", "aaaa"), "file", owner).Upload()
+	if err != nil || results.Files()[0].ID != f.ID {
+		t.Fatal("trashed file is not restored", err)
+	}
+	if Usage(owner) != 4 {
+		t.Error("usage after restore", Usage(owner))
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	testPackageinit(t)
+	if _, err := NewImport(owner).store("a.pdf", MaxFileSize+1, strings.NewReader("a")); err != ErrorTooLarge {
+		t.Error("expected too large got", err)
+	}
+}
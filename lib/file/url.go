@@ -0,0 +1,253 @@
+package file
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	shardPlaceholder = "{shard}"
+	versionLength    = 8
+)
+
+var (
+	ErrorSignature = errors.New("file: url signature not valid")
+	ErrorPurge     = errors.New("file: cdn purge failed")
+)
+
+// URLBuilder makes public url of file, name is file name with
+// size suffix like checksum*w150h150.jpg
+type URLBuilder interface {
+	URL(f *File, name string) string
+}
+
+// PrefixURL joins prefix and name, default builder using Config.ServingPrefix
+type PrefixURL struct {
+	Prefix string
+}
+
+func (p PrefixURL) URL(f *File, name string) string {
+	return filepath.Join(p.Prefix, name)
+}
+
+// CDN builds urls on Host, {shard} in host is replaced by a stable
+// shard number of file in [0, Shards). Version appends checksum of
+// content and SignKey signs urls expiring after SignTTL.
+type CDN struct {
+	Host    string
+	Shards  int
+	Version bool
+	SignKey []byte
+	SignTTL time.Duration
+}
+
+func (c CDN) URL(f *File, name string) string {
+	return c.build(f, name, c.Version, len(c.SignKey) > 0)
+}
+
+// PurgeURLs are cache keys of name, unsigned as signatures expire and
+// unversioned plus version of f when urls are versioned
+func (c CDN) PurgeURLs(f *File, name string) []string {
+	urls := []string{c.build(f, name, false, false)}
+	if c.Version {
+		urls = append(urls, c.build(f, name, true, false))
+	}
+	return urls
+}
+
+func (c CDN) build(f *File, name string, versioned, signed bool) string {
+	host := c.Host
+	if strings.Contains(host, shardPlaceholder) {
+		shard := 0
+		if c.Shards > 1 {
+			shard = int(crc32.ChecksumIEEE([]byte(f.Name)) % uint32(c.Shards))
+		}
+		host = strings.Replace(host, shardPlaceholder, strconv.Itoa(shard), -1)
+	}
+	u, err := url.Parse(strings.TrimRight(host, "/"))
+	if err != nil {
+		return path.Join(host, name)
+	}
+	u.Path = path.Join("/", u.Path, name)
+	query := url.Values{}
+	if versioned && f.ContentCheckSum() != "" {
+		version := f.ContentCheckSum()
+		if len(version) > versionLength {
+			version = version[:versionLength]
+		}
+		query.Set("v", version)
+	}
+	if signed {
+		expires := strconv.FormatInt(time.Now().Add(c.signTTL()).Unix(), 10)
+		query.Set("expires", expires)
+		query.Set("signature", sign(c.SignKey, u.Path, expires))
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (c CDN) signTTL() time.Duration {
+	if c.SignTTL > 0 {
+		return c.SignTTL
+	}
+	return time.Hour
+}
+
+// Verify checks signature of a request path signed by URL,
+// serving handler calls it before GetFile. Nothing is valid
+// without SignKey
+func (c CDN) Verify(urlPath string, query url.Values) error {
+	if len(c.SignKey) == 0 {
+		return ErrorSignature
+	}
+	expires := query.Get("expires")
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return ErrorSignature
+	}
+	want := sign(c.SignKey, urlPath, expires)
+	if !hmac.Equal([]byte(want), []byte(query.Get("signature"))) {
+		return ErrorSignature
+	}
+	return nil
+}
+
+func sign(key []byte, urlPath, expires string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(urlPath + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func urlFor(f *File, name string) string {
+	if config.URL != nil {
+		return config.URL.URL(f, name)
+	}
+	return PrefixURL{Prefix: config.ServingPrefix}.URL(f, name)
+}
+
+// URLs lists every public url of f which may be cached,
+// orginal and all preset sizes
+func (f *File) URLs() []string {
+	urls := []string{}
+	for _, name := range f.servedNames() {
+		urls = append(urls, urlFor(f, name))
+	}
+	return urls
+}
+
+// PurgeURLBuilder is a URLBuilder whose urls differ from what CDN
+// caches, like signed urls, it gives the cached urls to purge
+type PurgeURLBuilder interface {
+	PurgeURLs(f *File, name string) []string
+}
+
+// PurgeURLs lists cached urls of f to purge
+func (f *File) PurgeURLs() []string {
+	builder, ok := config.URL.(PurgeURLBuilder)
+	if !ok {
+		return f.URLs()
+	}
+	urls := []string{}
+	for _, name := range f.servedNames() {
+		urls = append(urls, builder.PurgeURLs(f, name)...)
+	}
+	return urls
+}
+
+// servedNames are names of orginal, poster and preset sizes
+func (f *File) servedNames() []string {
+	names := []string{f.Name}
+	if f.Format != Image && !f.hasPoster() {
+		return names
+	}
+	if f.hasPoster() {
+		names = append(names, f.Video.PosterName)
+	}
+	for _, preset := range DefaultPresets {
+		names = append(names, f.sizedName(preset))
+	}
+	return names
+}
+
+// Purger invalidates cached urls on CDN, set it as Config.Purger to
+// purge urls of deleted and replaced files
+type Purger interface {
+	Purge(urls []string) error
+}
+
+// HTTPPurger posts {"files": urls} as json to Endpoint with bearer
+// Token, the shape used by common CDN purge APIs
+type HTTPPurger struct {
+	Endpoint string
+	Token    string
+	Client   *http.Client
+}
+
+func (p HTTPPurger) Purge(urls []string) error {
+	body, err := json.Marshal(map[string]interface{}{"files": urls})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", p.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%v: %s", ErrorPurge, res.Status)
+	}
+	return nil
+}
+
+// purgeSubscriber purges urls of files leaving or changing on CDN
+type purgeSubscriber struct {
+	purger Purger
+}
+
+func (s purgeSubscriber) Handle(e Event) {
+	if e.Type != Deleted && e.Type != Replaced {
+		return
+	}
+	urls := e.File.PurgeURLs()
+	if e.Previous != nil {
+		// versioned urls of old content are the cached ones
+		seen := map[string]bool{}
+		for _, u := range urls {
+			seen[u] = true
+		}
+		for _, u := range e.Previous.PurgeURLs() {
+			if !seen[u] {
+				urls = append(urls, u)
+			}
+		}
+	}
+	if err := s.purger.Purge(urls); err != nil {
+		log.Println("file: purge", e.File.Name, err)
+	}
+}
@@ -0,0 +1,124 @@
+package file
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeyem/gocommerce/util/repository"
+)
+
+func TestCDNURL(t *testing.T) {
+	cdn := CDN{
+		Host:    "https://img{shard}.example.com/media",
+		Shards:  4,
+		Version: true,
+		SignKey: []byte("secret"),
+	}
+	config = &Config{URL: cdn}
+	f := &File{
+		Name:     "dae49be638e75b306cd116bfdb0632d5.jpg",
+		CheckSum: "dae49be638e75b306cd116bfdb0632d5",
+		Format:   Image,
+	}
+	u, err := url.Parse(f.Thumb())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(u.Host, "img") || !strings.HasSuffix(u.Host, ".example.com") {
+		t.Errorf("unexpected host %s", u.Host)
+	}
+	if u.Path != "/media/dae49be638e75b306cd116bfdb0632d5*w150h150.jpg" {
+		t.Errorf("unexpected path %s", u.Path)
+	}
+	if u.Query().Get("v") != "dae49be6" {
+		t.Errorf("unexpected version %s", u.Query().Get("v"))
+	}
+	if err := cdn.Verify(u.Path, u.Query()); err != nil {
+		t.Error(err)
+	}
+	if err := cdn.Verify("/media/other.jpg", u.Query()); err != ErrorSignature {
+		t.Errorf("expected signature error got %v", err)
+	}
+	if o, _ := url.Parse(f.Orginal()); o.Host != u.Host {
+		t.Errorf("sizes of a file must share host %s %s", o.Host, u.Host)
+	}
+}
+
+func TestHTTPPurger(t *testing.T) {
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body := map[string][]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		got = body["files"]
+	}))
+	defer ts.Close()
+	config = &Config{ServingPrefix: "/static"}
+	f := &File{Name: "a.jpg", Format: Image}
+	if err := (HTTPPurger{Endpoint: ts.URL, Token: "token"}).Purge(f.URLs()); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1+len(DefaultPresets) || got[0] != "/static/a.jpg" {
+		t.Errorf("unexpected purged urls %v", got)
+	}
+	if err := (HTTPPurger{Endpoint: ts.URL}).Purge(nil); err == nil {
+		t.Error("expected unauthorized purge to fail")
+	}
+}
+
+func TestVerifyWithoutKey(t *testing.T) {
+	cdn := CDN{Host: "https://img.example.com"}
+	query := url.Values{
+		"expires":   {"9999999999"},
+		"signature": {sign(nil, "/a.jpg", "9999999999")},
+	}
+	if err := cdn.Verify("/a.jpg", query); err != ErrorSignature {
+		t.Errorf("expected signature error got %v", err)
+	}
+}
+
+type recordPurger chan []string
+
+func (p recordPurger) Purge(urls []string) error {
+	p <- urls
+	return nil
+}
+
+func TestPurgeReplaced(t *testing.T) {
+	cdn := CDN{Host: "https://img.example.com", Version: true, SignKey: []byte("secret")}
+	purged := make(recordPurger, 1)
+	RegisterRepository(repository.NewMemory(), Config{URL: cdn, Purger: purged})
+	defer RegisterRepository(repository.NewMemory(), Config{})
+	previous := File{Name: "a.pdf", CheckSum: "aaaaaaaaaa", Format: Content}
+	current := previous
+	current.ContentSum = "bbbbbbbbbb"
+	publish(Event{Type: Replaced, File: current, Previous: &previous})
+	var urls []string
+	select {
+	case urls = <-purged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing purged")
+	}
+	want := map[string]bool{
+		"https://img.example.com/a.pdf":            true,
+		"https://img.example.com/a.pdf?v=bbbbbbbb": true,
+		"https://img.example.com/a.pdf?v=aaaaaaaa": true,
+	}
+	for _, u := range urls {
+		if !want[u] {
+			t.Error("unexpected purged url", u)
+		}
+		delete(want, u)
+	}
+	if len(want) != 0 {
+		t.Error("not purged", want)
+	}
+}
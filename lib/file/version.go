@@ -0,0 +1,229 @@
+package file
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jeyem/gocommerce/util/repository"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	ErrorNoVersion = errors.New("file: version not found")
+)
+
+// Version is a content of a file, File.Path always points to content
+// of current version while name, id and urls of file never change
+type Version struct {
+	ID        bson.ObjectId `bson:"_id,omitempty"`
+	File      bson.ObjectId `bson:"file"`
+	Number    int           `bson:"number"`
+	Path      string        `bson:"path"`
+	CheckSum  string        `bson:"check_sum"`
+	Size      int64         `bson:"size"`
+	CreatedAt time.Time     `bson:"created_at"`
+}
+
+func (Version) Meta() []mgo.Index {
+	return []mgo.Index{
+		{Key: []string{"file", "number"}, Unique: true},
+	}
+}
+
+// CurrentVersion is 1 for files never replaced
+func (f *File) CurrentVersion() int {
+	if f.Version < 1 {
+		return 1
+	}
+	return f.Version
+}
+
+// ContentCheckSum is checksum of current content, CheckSum stays
+// the checksum of first upload as identity of file
+func (f *File) ContentCheckSum() string {
+	if f.ContentSum != "" {
+		return f.ContentSum
+	}
+	return f.CheckSum
+}
+
+// Versions lists content history, newest first
+func (f *File) Versions() (versions []Version, err error) {
+	err = db.Where(bson.M{"file": f.ID}).Sort("-number").Find(&versions)
+	if err == nil && len(versions) == 0 {
+		versions = []Version{f.firstVersion()}
+	}
+	return versions, err
+}
+
+// Replace stores content of r as a new version of f and makes it current,
+// derivatives of previous content are removed
+func (f *File) Replace(r io.Reader) error {
+	if f.Trashed() {
+		return ErrorTrashed
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(r, MaxFileSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(content)) > MaxFileSize {
+		return ErrorTooLarge
+	}
+	switch f.Format {
+	case Vector:
+		if content, err = sanitizeSVG(bytes.NewReader(content)); err != nil {
+			return err
+		}
+	case Image:
+		if _, _, err := image.DecodeConfig(bytes.NewReader(content)); err != nil {
+			return ErrorNotValidFile
+		}
+	}
+	checksum := fmt.Sprintf("%x", md5.Sum(content))
+	if checksum == f.ContentCheckSum() {
+		return nil
+	}
+	// content of every version is kept
+	if config.Quota > 0 && Usage(f.Owner)+int64(len(content)) > config.Quota {
+		return ErrorQuota
+	}
+	if err := f.ensureFirstVersion(); err != nil {
+		return err
+	}
+	last := new(Version)
+	if err := db.Where(bson.M{"file": f.ID}).Sort("-number").Find(last); err != nil {
+		return err
+	}
+	number := last.Number + 1
+	// named by file and number, content named by checksum may be
+	// another file of owner with the same bytes
+	subDirectory := filepath.Join(f.Owner.Hex(), time.Now().Format("200601"))
+	path := filepath.Join(subDirectory, fmt.Sprintf("%s_v%d%s", f.ID.Hex(), number, f.Ext()))
+	fullDirectoryPath := filepath.Join(config.ImagePath, subDirectory)
+	if _, err := os.Stat(fullDirectoryPath); os.IsNotExist(err) {
+		os.MkdirAll(fullDirectoryPath, 0777)
+	}
+	if err := ioutil.WriteFile(filepath.Join(config.ImagePath, path), content, 0666); err != nil {
+		return err
+	}
+	version := &Version{
+		File:      f.ID,
+		Number:    number,
+		Path:      path,
+		CheckSum:  checksum,
+		Size:      int64(len(content)),
+		CreatedAt: time.Now(),
+	}
+	if err := db.Create(version); err != nil {
+		return err
+	}
+	return f.switchTo(version)
+}
+
+// Rollback makes a previous version current again
+func (f *File) Rollback(number int) error {
+	if f.Trashed() {
+		return ErrorTrashed
+	}
+	if number == f.CurrentVersion() {
+		return nil
+	}
+	if err := f.ensureFirstVersion(); err != nil {
+		return err
+	}
+	version := new(Version)
+	if err := db.Where(bson.M{
+		"file": f.ID, "number": number,
+	}).Find(version); err != nil {
+		return ErrorNoVersion
+	}
+	return f.switchTo(version)
+}
+
+func (f *File) switchTo(v *Version) error {
+	previous := *f
+	f.Path = v.Path
+	f.Size = v.Size
+	f.Version = v.Number
+	f.ContentSum = v.CheckSum
+	if v.CheckSum == f.CheckSum {
+		f.ContentSum = ""
+	}
+	if err := db.Update(f); err != nil {
+		*f = previous
+		return err
+	}
+	// derivatives are named by file name so drop the ones of old content
+	for _, path := range derivatives(previous.derivativeBase()) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Println("file: invalidate derivative", path, err)
+		}
+	}
+	publish(Event{
+		Type:     Replaced,
+		File:     *f,
+		Path:     filepath.Join(config.ImagePath, f.Path),
+		Time:     time.Now(),
+		Previous: &previous,
+	})
+	enqueue(*f)
+	return nil
+}
+
+// ensureFirstVersion records content of first upload before it is
+// replaced for the first time, the record and Version of f are stored
+// together so a failed replace can be tried again
+func (f *File) ensureFirstVersion() error {
+	if f.Version > 0 {
+		return nil
+	}
+	first := f.firstVersion()
+	// left by a replace which failed to store Version of f
+	err := db.Where(bson.M{"file": f.ID, "number": first.Number}).Find(&Version{})
+	if err == repository.ErrNotFound {
+		if err := db.Create(&first); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	f.Version = first.Number
+	if err := db.Update(f); err != nil {
+		f.Version = 0
+		return err
+	}
+	return nil
+}
+
+func (f *File) firstVersion() Version {
+	return Version{
+		File:      f.ID,
+		Number:    1,
+		Path:      f.Path,
+		CheckSum:  f.ContentCheckSum(),
+		Size:      f.Size,
+		CreatedAt: f.CreatedAt,
+	}
+}
+
+// derivativeBase is orginal path derivatives of current content are
+// named after, sizes live next to content but carry file name
+func (f *File) derivativeBase() string {
+	return filepath.Join(config.ImagePath, filepath.Dir(f.Path), f.Name)
+}
+
+func (f *File) derivativePath(preset string) string {
+	return filepath.Join(config.ImagePath, filepath.Dir(f.Path),
+		f.NameNoExt()+preset+f.Ext())
+}
@@ -0,0 +1,125 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeyem/gocommerce/util/repository"
+)
+
+func storeTest(t *testing.T, name, content string) *File {
+	f, err := NewImport(owner).store(name, int64(len(content)), strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestReplaceRollback(t *testing.T) {
+	testPackageinit(t)
+	a := storeTest(t, "a.pdf", "a")
+	b := storeTest(t, "b.pdf", "b")
+	if err := a.Replace(strings.NewReader("b")); err != nil {
+		t.Fatal(err)
+	}
+	if a.Path == b.Path || a.CurrentVersion() != 2 || a.ContentCheckSum() != b.CheckSum {
+		t.Fatal("replaced content shares path of other file", a.Path)
+	}
+	if err := a.Replace(strings.NewReader("c")); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := a.Versions()
+	if err != nil || len(versions) != 3 || versions[0].Number != 3 || versions[2].CheckSum != a.CheckSum {
+		t.Fatal("versions", versions, err)
+	}
+	if err := a.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	if a.Path != versions[2].Path || a.ContentSum != "" || a.Size != 1 {
+		t.Error("rollback to first version", a)
+	}
+	if err := a.Rollback(9); err != ErrorNoVersion {
+		t.Error("rollback to missing version", err)
+	}
+
+	if err := a.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Replace(strings.NewReader("d")); err != ErrorTrashed {
+		t.Error("trashed file replaced", err)
+	}
+	if err := a.Rollback(2); err != ErrorTrashed {
+		t.Error("trashed file rolled back", err)
+	}
+	if err := a.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range versions {
+		if _, err := os.Stat(filepath.Join(config.ImagePath, v.Path)); !os.IsNotExist(err) {
+			t.Error("version is not purged", v.Path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(config.ImagePath, b.Path)); err != nil {
+		t.Error("content of other file is removed", err)
+	}
+}
+
+func TestPurgeSharedPath(t *testing.T) {
+	testPackageinit(t)
+	a := storeTest(t, "a.pdf", "a")
+	b := storeTest(t, "b.pdf", "b")
+	// replaced by an older release to content path of b
+	if err := db.Create(&Version{File: a.ID, Number: 2, Path: b.Path, CheckSum: b.CheckSum}); err != nil {
+		t.Fatal(err)
+	}
+	a.Version = 2
+	if err := a.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(config.ImagePath, b.Path)); err != nil {
+		t.Error("shared content is removed", err)
+	}
+}
+
+func TestReplaceAfterFailure(t *testing.T) {
+	testPackageinit(t)
+	a := storeTest(t, "a.pdf", "a")
+	// a directory where second version is written fails the replace
+	blocked := filepath.Join(config.ImagePath, a.Owner.Hex(), time.Now().Format("200601"),
+		a.ID.Hex()+"_v2.pdf")
+	if err := os.MkdirAll(blocked, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Replace(strings.NewReader("b")); err == nil {
+		t.Fatal("replace over a directory")
+	}
+	stored := new(File)
+	if err := db.Get(stored, a.ID); err != nil || stored.Version != 1 {
+		t.Fatal("version of first record is not stored", stored.Version, err)
+	}
+	os.Remove(blocked)
+	if err := stored.Replace(strings.NewReader("b")); err != nil {
+		t.Fatal("replace after failure", err)
+	}
+	if versions, _ := stored.Versions(); len(versions) != 2 {
+		t.Error("versions", versions)
+	}
+}
+
+func TestReplaceQuota(t *testing.T) {
+	RegisterRepository(repository.NewMemory(), Config{ImagePath: t.TempDir(), Quota: 3})
+	a := storeTest(t, "a.pdf", "a")
+	if err := a.Replace(strings.NewReader("bb")); err != nil {
+		t.Fatal(err)
+	}
+	// first content is kept as a version
+	if Usage(owner) != 3 {
+		t.Error("usage of versions", Usage(owner))
+	}
+	if err := a.Replace(strings.NewReader("cc")); err != ErrorQuota {
+		t.Error("replace over quota", err)
+	}
+}
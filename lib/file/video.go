@@ -0,0 +1,189 @@
+package file
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	maxPosterOffset = 5 * time.Second
+)
+
+var (
+	ErrorNoVideoStream = errors.New("file: no video stream")
+)
+
+// VideoMeta is stored on video files after probing
+type VideoMeta struct {
+	Duration   time.Duration `bson:"duration"`
+	Width      int           `bson:"width"`
+	Height     int           `bson:"height"`
+	Poster     bson.ObjectId `bson:"poster,omitempty"`
+	PosterName string        `bson:"poster_name,omitempty"`
+}
+
+type VideoInfo struct {
+	Duration      time.Duration
+	Width, Height int
+}
+
+// VideoProber reads video metadata and extracts a jpeg frame at given
+// offset into dest, set it as Config.Video to enable posters
+type VideoProber interface {
+	Probe(path string) (VideoInfo, error)
+	Poster(path, dest string, at time.Duration) error
+}
+
+// FFmpeg probes videos by running ffprobe and ffmpeg binaries,
+// empty paths are looked up in PATH
+type FFmpeg struct {
+	FFprobePath string
+	FFmpegPath  string
+}
+
+func (ff FFmpeg) Probe(path string) (VideoInfo, error) {
+	info := VideoInfo{}
+	out, err := run(ff.bin(ff.FFprobePath, "ffprobe"),
+		"-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height:format=duration",
+		"-of", "json", path)
+	if err != nil {
+		return info, err
+	}
+	probe := struct {
+		Streams []struct {
+			Width  int `json:"width"`
+			Height int `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}{}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return info, err
+	}
+	if len(probe.Streams) == 0 {
+		return info, ErrorNoVideoStream
+	}
+	info.Width = probe.Streams[0].Width
+	info.Height = probe.Streams[0].Height
+	if seconds, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		info.Duration = time.Duration(seconds * float64(time.Second))
+	}
+	return info, nil
+}
+
+func (ff FFmpeg) Poster(path, dest string, at time.Duration) error {
+	_, err := run(ff.bin(ff.FFmpegPath, "ffmpeg"),
+		"-v", "error", "-y", "-ss", fmt.Sprintf("%.3f", at.Seconds()),
+		"-i", path, "-frames:v", "1", "-q:v", "2", "-f", "image2", dest)
+	return err
+}
+
+func (FFmpeg) bin(path, name string) string {
+	if path != "" {
+		return path
+	}
+	return name
+}
+
+func run(name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v %s", name, err, stderr.String())
+	}
+	return out, nil
+}
+
+// ProcessVideo probes video file, saves its poster as an image File
+// linked to video and stores metadata on f
+func ProcessVideo(f *File) error {
+	if f.Format != Video || config.Video == nil {
+		return nil
+	}
+	poster, info, err := makePoster(config.Video, f)
+	if err != nil {
+		return err
+	}
+	path := poster.Path
+	if err := poster.Save(); err == ErrorDuplicate {
+		// same frame already uploaded, link to existing image
+		if err := poster.Load(poster.CheckSum, poster.Owner); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if poster.Path != path {
+		os.Remove(filepath.Join(config.ImagePath, path))
+	}
+	f.Video = &VideoMeta{
+		Duration:   info.Duration,
+		Width:      info.Width,
+		Height:     info.Height,
+		Poster:     poster.ID,
+		PosterName: poster.Name,
+	}
+	if err := db.Update(f); err != nil {
+		return err
+	}
+	emit(DerivativeCreated, *f, filepath.Join(config.ImagePath, poster.Path))
+	return nil
+}
+
+// makePoster writes poster frame of video next to it named by checksum
+func makePoster(prober VideoProber, f *File) (*File, VideoInfo, error) {
+	src := filepath.Join(config.ImagePath, f.Path)
+	info, err := prober.Probe(src)
+	if err != nil {
+		return nil, info, err
+	}
+	at := info.Duration / 10
+	if at > maxPosterOffset {
+		at = maxPosterOffset
+	}
+	dir := filepath.Dir(src)
+	tmp := filepath.Join(dir, f.NameNoExt()+"_poster."+defaultImageExt)
+	if err := prober.Poster(src, tmp, at); err != nil {
+		return nil, info, err
+	}
+	poster, err := os.Open(tmp)
+	if err != nil {
+		return nil, info, err
+	}
+	checksum, err := getMD5Checksum(poster)
+	if err != nil {
+		poster.Close()
+		return nil, info, err
+	}
+	stat, err := poster.Stat()
+	poster.Close()
+	if err != nil {
+		return nil, info, err
+	}
+	name := checksum + "." + defaultImageExt
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		return nil, info, err
+	}
+	return &File{
+		Owner:    f.Owner,
+		Name:     name,
+		Path:     filepath.Join(filepath.Dir(f.Path), name),
+		Format:   Image,
+		CheckSum: checksum,
+		Size:     stat.Size(),
+		Parent:   f.ID,
+	}, info, nil
+}
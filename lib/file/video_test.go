@@ -0,0 +1,109 @@
+package file
+
+import (
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeProber struct {
+	info VideoInfo
+	at   time.Duration
+}
+
+func (p *fakeProber) Probe(path string) (VideoInfo, error) {
+	if _, err := os.Stat(path); err != nil {
+		return VideoInfo{}, err
+	}
+	return p.info, nil
+}
+
+func (p *fakeProber) Poster(path, dest string, at time.Duration) error {
+	p.at = at
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img := image.NewRGBA(image.Rect(0, 0, p.info.Width, p.info.Height))
+	return jpeg.Encode(f, img, nil)
+}
+
+func TestMakePoster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config = &Config{ImagePath: dir}
+	video := &File{
+		Owner:  owner,
+		Name:   "5d41402abc4b2a76b9719d911017c592.mp4",
+		Path:   "5d41402abc4b2a76b9719d911017c592.mp4",
+		Format: Video,
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, video.Path), []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prober := &fakeProber{info: VideoInfo{
+		Duration: 20 * time.Second, Width: 64, Height: 48,
+	}}
+	poster, info, err := makePoster(prober, video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info != prober.info {
+		t.Errorf("unexpected info %v", info)
+	}
+	if prober.at != 2*time.Second {
+		t.Errorf("poster taken at %v", prober.at)
+	}
+	if poster.Format != Image || poster.Parent != video.ID || poster.Owner != owner {
+		t.Errorf("unexpected poster %v", poster)
+	}
+	if _, err := os.Stat(filepath.Join(dir, poster.Path)); err != nil {
+		t.Error(err)
+	}
+	if poster.Name != poster.CheckSum+".jpg" {
+		t.Errorf("poster not named by checksum %s", poster.Name)
+	}
+}
+
+func TestFFmpeg(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not available")
+	}
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		t.Skip("ffprobe not available")
+	}
+	dir, err := ioutil.TempDir("", "ffmpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	video := filepath.Join(dir, "test.mp4")
+	if out, err := exec.Command("ffmpeg", "-v", "error", "-f", "lavfi",
+		"-i", "testsrc=duration=2:size=64x48:rate=10", video).CombinedOutput(); err != nil {
+		t.Skip("ffmpeg can not encode test video ", string(out))
+	}
+	ff := FFmpeg{}
+	info, err := ff.Probe(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 64 || info.Height != 48 || info.Duration < time.Second {
+		t.Errorf("unexpected info %v", info)
+	}
+	poster := filepath.Join(dir, "poster.jpg")
+	if err := ff.Poster(video, poster, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(poster); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,60 @@
+package user
+
+import "github.com/jeyem/gocommerce/lib/file"
+
+const (
+	entityUser  = "user"
+	fieldAvatar = "avatar"
+)
+
+func init() {
+	file.RegisterEntity(entityUser, func(ref file.Reference) error {
+		u := new(User)
+		if err := u.Load(ref.EntityID); err != nil {
+			return err
+		}
+		if ref.Field == fieldAvatar {
+			u.Avatar = ""
+			u.AvatarFile = ""
+		}
+		return u.Update()
+	})
+}
+
+// SetAvatar points avatar to f and tracks the usage so the file
+// can not be deleted while it is user avatar, previous avatar is
+// released only once user points to f
+func (u *User) SetAvatar(f *file.File) error {
+	if err := f.Use(entityUser, u.ID, fieldAvatar); err != nil {
+		return err
+	}
+	avatar, previous := u.Avatar, u.AvatarFile
+	u.Avatar = f.Orginal()
+	u.AvatarFile = f.ID
+	if err := u.Update(); err != nil {
+		u.Avatar, u.AvatarFile = avatar, previous
+		return err
+	}
+	if !previous.Valid() || previous == f.ID {
+		return nil
+	}
+	return (&file.File{ID: previous}).Release(entityUser, u.ID, fieldAvatar)
+}
+
+// RemoveAvatar unsets avatar and releases its file
+func (u *User) RemoveAvatar() error {
+	if err := u.releaseAvatar(); err != nil {
+		return err
+	}
+	u.Avatar = ""
+	return u.Update()
+}
+
+func (u *User) releaseAvatar() error {
+	if !u.AvatarFile.Valid() {
+		return nil
+	}
+	f := &file.File{ID: u.AvatarFile}
+	u.AvatarFile = ""
+	return f.Release(entityUser, u.ID, fieldAvatar)
+}
@@ -0,0 +1,65 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/jeyem/gocommerce/lib/file"
+	"github.com/jeyem/gocommerce/util/repository"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSetAvatar(t *testing.T) {
+	testPackageinit()
+	file.RegisterRepository(repository.NewMemory(), file.Config{ImagePath: t.TempDir()})
+	u, err := Form{Email: "avatar@test.com", Password: "secret"}.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &file.File{Owner: u.ID, Name: "a.jpg", Path: "a.jpg", Format: file.Image, CheckSum: "a"}
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetAvatar(f); err != nil {
+		t.Fatal(err)
+	}
+	if u.AvatarFile != f.ID || u.Avatar == "" || !f.InUse() {
+		t.Fatal("avatar is not set", u.Avatar)
+	}
+	if err := f.Delete(); err != file.ErrorInUse {
+		t.Error("avatar deleted", err)
+	}
+	if err := f.DeleteCascade(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := new(User)
+	loaded.Load(u.ID)
+	if loaded.Avatar != "" || loaded.AvatarFile.Valid() || !f.Trashed() {
+		t.Error("cascade did not clear avatar", loaded.Avatar)
+	}
+
+	g := &file.File{Owner: u.ID, Name: "b.jpg", Path: "b.jpg", Format: file.Image, CheckSum: "b"}
+	g.Save()
+	if err := u.SetAvatar(g); err != nil {
+		t.Fatal(err)
+	}
+	// setting the same avatar again keeps its reference
+	if err := u.SetAvatar(g); err != nil || !g.InUse() {
+		t.Error("avatar set again is released", err)
+	}
+	// failing to use new file keeps the old avatar referenced
+	if err := u.SetAvatar(f); err != file.ErrorTrashed {
+		t.Error("trashed file set as avatar", err)
+	}
+	if u.AvatarFile != g.ID || !g.InUse() {
+		t.Error("old avatar is released before new one is used")
+	}
+	if err := u.RemoveAvatar(); err != nil || g.InUse() || u.Avatar != "" {
+		t.Error("remove avatar", err)
+	}
+
+	// reference of a user which can not be loaded stops the cascade
+	g.Use(entityUser, bson.NewObjectId(), fieldAvatar)
+	if err := g.DeleteCascade(); err == nil || g.Trashed() {
+		t.Error("cascade of missing user", err)
+	}
+}
@@ -1,6 +1,8 @@
 package user
 
 import (
+	"strings"
+
 	"github.com/asaskevich/govalidator"
 )
 
@@ -9,6 +11,8 @@ type Form struct {
 	Call     string `form:"call" json:"call"`
 	Email    string `form:"email" json:"email" valid:"required"`
 	Password string `form:"password" json:"password" valid:"required"`
+	// IP of client counts failed logins per address, set by handler
+	IP string `form:"-" json:"-"`
 }
 
 type CallForm struct {
@@ -22,38 +26,50 @@ type MailForm struct {
 type SecureKeyForm struct {
 	Identifier string `form:"identifier" json:"identifier" valid:"required"`
 	Key        string `form:"key" json:"key" valid:"required"`
+	IP         string `form:"-" json:"-"`
+}
+
+type UnlockForm struct {
+	Identifier string `form:"identifier" json:"identifier" valid:"required"`
+	Key        string `form:"key" json:"key" valid:"required"`
 }
 
-func (f Form) Login() (*User, error) {
+// Login checks email and password, users with TOTP enabled get a
+// challenge for SecondFactorForm instead of the user
+func (f Form) Login() (*LoginResult, error) {
 	if _, err := govalidator.ValidateStruct(f); err != nil {
 		return nil, err
 	}
-	u := new(User)
-	if err := u.Auth(f.Email, f.Password); err != nil {
-		return nil, err
-	}
-	return u, nil
-
+	return new(User).authByMail(EmailFixer(f.Email), f.Password, f.IP)
 }
 
 func (f Form) Register() (*User, error) {
 	if _, err := govalidator.ValidateStruct(f); err != nil {
 		return nil, err
 	}
+	password, err := MakePassword(f.Password)
+	if err != nil {
+		return nil, err
+	}
 	u := &User{
 		Fullname:   f.Fullname,
 		Email:      EmailFixer(f.Email),
 		OrginEmail: f.Email,
-		Password:   MakePassword(f.Password),
+		Password:   password,
 	}
 	if err := u.Save(); err != nil {
 		return nil, err
 	}
+	if err := u.SendVerification(); err != nil {
+		return nil, err
+	}
 	return u, nil
 
 }
 
 func (f CallForm) StepsLogin() (*User, error) {
+	// stored calls are fixed, a call without digits is empty
+	f.Call = CallFixer(f.Call)
 	if _, err := govalidator.ValidateStruct(f); err != nil {
 		return nil, err
 	}
@@ -65,6 +81,9 @@ func (f CallForm) StepsLogin() (*User, error) {
 	if err := u.Save(); err != nil {
 		return nil, err
 	}
+	if err := u.sendSecureKey(ChannelSMS); err != nil {
+		return nil, err
+	}
 	return u, nil
 }
 
@@ -81,20 +100,29 @@ func (f MailForm) StepsLogin() (*User, error) {
 	if err := u.Save(); err != nil {
 		return nil, err
 	}
+	if err := u.sendSecureKey(ChannelEmail); err != nil {
+		return nil, err
+	}
 	return u, nil
 }
 
-func (f SecureKeyForm) Login() (*User, error) {
+// Login checks secure key, users with TOTP enabled get a challenge
+// for SecondFactorForm instead of the user
+func (f SecureKeyForm) Login() (*LoginResult, error) {
 	if _, err := govalidator.ValidateStruct(f); err != nil {
 		return nil, err
 	}
-	u = new(User)
-	if err := u.AuthByCallAndSecureKey(f.Identifier, f.Key); err == nil {
-		return u, nil
+	f.Identifier = fixIdentifier(f.Identifier)
+	field := "call"
+	if strings.Contains(f.Identifier, "@") {
+		field = "email"
 	}
-	f.Identifier = EmailFixer(f.Identifier)
-	if err := u.AuthByMailAndSecureKey(f.Identifier, f.Key); err != nil {
+	return new(User).authBySecureKey(field, f.Identifier, f.Key, f.IP)
+}
+
+func (f UnlockForm) Unlock() (*User, error) {
+	if _, err := govalidator.ValidateStruct(f); err != nil {
 		return nil, err
 	}
-	return u, nil
+	return UnlockByKey(f.Identifier, f.Key)
 }
@@ -0,0 +1,371 @@
+package user
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/jeyem/gocommerce/util/random"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Hasher makes and checks password hashes of one algorithm, parameters
+// of a hash are read from the hash itself so they can change over time
+type Hasher interface {
+	Hash(password string) (string, error)
+	// Identify reports whether encoded is made by the algorithm
+	Identify(encoded string) bool
+	// Valid reports whether encoded is well formed and its parameters
+	// are in limits, Verify of an invalid hash is always false
+	Valid(encoded string) bool
+	Verify(password, encoded string) bool
+	// Outdated reports whether encoded is weaker than parameters of
+	// the hasher and should be made again
+	Outdated(encoded string) bool
+}
+
+var (
+	// passwordHasher makes new hashes, see SetHasher
+	passwordHasher Hasher = Argon2id{Time: 3, Memory: 64 * 1024, Threads: 2}
+
+	// hashers are checked in order by CheckPassword
+	hashers = []Hasher{Argon2id{}, Bcrypt{}, PBKDF2{}, PHPass{}, Salted{}}
+
+	phcEncoding = base64.RawStdEncoding
+)
+
+// parameters are read from stored hashes, above these limits a hash
+// is refused so it can not make a login take unbounded time or memory
+const (
+	maxPBKDF2Iterations = 5000000
+	maxArgon2Memory     = 1 << 20 // KiB
+	maxArgon2Time       = 10
+	maxArgon2Threads    = 16
+	maxBcryptCost       = 16
+	maxPHPassRounds     = 18
+)
+
+// SetHasher sets hasher of new passwords, hashes of other algorithms
+// or weaker parameters are upgraded at login
+func SetHasher(h Hasher) {
+	passwordHasher = h
+}
+
+// PBKDF2 hashes are pbkdf2:sha256:iterations$salt$hex
+type PBKDF2 struct {
+	Iterations int
+}
+
+func (h PBKDF2) Hash(password string) (string, error) {
+	iter := h.Iterations
+	if iter == 0 {
+		iter = iterations
+	}
+	salt := random.String(saltLength, saltChars)
+	key := pbkdf2.Key([]byte(password), []byte(salt), iter, charLength/2, sha256.New)
+	return fmt.Sprintf("%s:%d$%s$%s", method, iter, salt, hex.EncodeToString(key)), nil
+}
+
+func (PBKDF2) Identify(encoded string) bool {
+	return strings.HasPrefix(encoded, "pbkdf2:")
+}
+
+func (PBKDF2) Valid(encoded string) bool {
+	_, _, _, _, ok := parsePBKDF2(encoded)
+	return ok
+}
+
+func (PBKDF2) Verify(password, encoded string) bool {
+	digest, iter, salt, key, ok := parsePBKDF2(encoded)
+	if !ok {
+		return false
+	}
+	made := pbkdf2.Key([]byte(password), []byte(salt), iter, len(key), digest)
+	return subtle.ConstantTimeCompare(made, key) == 1
+}
+
+func (h PBKDF2) Outdated(encoded string) bool {
+	_, iter, _, _, ok := parsePBKDF2(encoded)
+	return !ok || !strings.HasPrefix(encoded, method+":") || iter < h.Iterations
+}
+
+func parsePBKDF2(encoded string) (func() hash.Hash, int, string, []byte, bool) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 3 {
+		return nil, 0, "", nil, false
+	}
+	params := strings.Split(parts[0], ":")
+	if len(params) < 2 || len(params) > 3 {
+		return nil, 0, "", nil, false
+	}
+	var digest func() hash.Hash
+	switch params[1] {
+	case "sha256":
+		digest = sha256.New
+	case "sha512":
+		digest = sha512.New
+	default:
+		return nil, 0, "", nil, false
+	}
+	iter := iterations
+	if len(params) == 3 {
+		var err error
+		if iter, err = strconv.Atoi(params[2]); err != nil || iter < 1 ||
+			iter > maxPBKDF2Iterations {
+			return nil, 0, "", nil, false
+		}
+	}
+	key, err := hex.DecodeString(parts[2])
+	if err != nil || len(key) == 0 {
+		return nil, 0, "", nil, false
+	}
+	return digest, iter, parts[1], key, true
+}
+
+// Argon2id hashes are in PHC format
+// $argon2id$v=19$m=memory,t=time,p=threads$salt$key
+type Argon2id struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+func (h Argon2id) Hash(password string) (string, error) {
+	salt := random.Bytes(argon2SaltLength)
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		h.Memory, h.Time, h.Threads,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+func (Argon2id) Identify(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (Argon2id) Valid(encoded string) bool {
+	_, _, _, ok := parseArgon2id(encoded)
+	return ok
+}
+
+func (Argon2id) Verify(password, encoded string) bool {
+	params, salt, key, ok := parseArgon2id(encoded)
+	if !ok {
+		return false
+	}
+	made := argon2.IDKey([]byte(password), salt,
+		params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(made, key) == 1
+}
+
+func (h Argon2id) Outdated(encoded string) bool {
+	params, _, key, ok := parseArgon2id(encoded)
+	return !ok || params.Time < h.Time || params.Memory < h.Memory ||
+		params.Threads < h.Threads || len(key) < argon2KeyLength
+}
+
+func parseArgon2id(encoded string) (Argon2id, []byte, []byte, bool) {
+	var params Argon2id
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" ||
+		parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return params, nil, nil, false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d",
+		&params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, false
+	}
+	if params.Time == 0 || params.Threads == 0 || params.Time > maxArgon2Time ||
+		params.Memory > maxArgon2Memory || params.Threads > maxArgon2Threads {
+		return params, nil, nil, false
+	}
+	salt, err1 := phcEncoding.DecodeString(parts[4])
+	key, err2 := phcEncoding.DecodeString(parts[5])
+	if err1 != nil || err2 != nil || len(key) == 0 {
+		return params, nil, nil, false
+	}
+	return params, salt, key, true
+}
+
+// Bcrypt hashes are $2a$, $2b$ or $2y$ hashes, passwords longer than
+// 72 bytes can not be hashed
+type Bcrypt struct {
+	Cost int
+}
+
+const (
+	bcryptLength   = 60
+	bcryptAlphabet = "./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+func (h Bcrypt) Hash(password string) (string, error) {
+	cost := h.Cost
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	encoded, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	return string(encoded), err
+}
+
+func (Bcrypt) Identify(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+// Valid checks length, cost and alphabet of salt and hash
+func (h Bcrypt) Valid(encoded string) bool {
+	if !h.Identify(encoded) || len(encoded) != bcryptLength {
+		return false
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err == nil && cost >= bcrypt.MinCost && cost <= maxBcryptCost &&
+		strings.Trim(encoded[7:], bcryptAlphabet) == ""
+}
+
+func (h Bcrypt) Verify(password, encoded string) bool {
+	if !h.Valid(encoded) {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+}
+
+func (h Bcrypt) Outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < h.Cost
+}
+
+// PHPass checks portable $P$ and $H$ hashes of WordPress and
+// WooCommerce, it only checks imported hashes
+type PHPass struct{}
+
+const phpassItoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func (PHPass) Hash(string) (string, error) {
+	return "", ErrorLegacyHash
+}
+
+func (PHPass) Identify(encoded string) bool {
+	return len(encoded) == 34 &&
+		(strings.HasPrefix(encoded, "$P$") || strings.HasPrefix(encoded, "$H$"))
+}
+
+// Valid checks rounds and alphabet of salt and hash
+func (h PHPass) Valid(encoded string) bool {
+	if !h.Identify(encoded) {
+		return false
+	}
+	rounds := strings.IndexByte(phpassItoa64, encoded[3])
+	return rounds >= 7 && rounds <= maxPHPassRounds &&
+		strings.Trim(encoded[4:], phpassItoa64) == ""
+}
+
+func (h PHPass) Verify(password, encoded string) bool {
+	if !h.Valid(encoded) {
+		return false
+	}
+	rounds := strings.IndexByte(phpassItoa64, encoded[3])
+	salt := encoded[4:12]
+	sum := md5.Sum([]byte(salt + password))
+	for i := 0; i < 1<<uint(rounds); i++ {
+		sum = md5.Sum(append(sum[:], password...))
+	}
+	made := encoded[:12] + phpassEncode(sum[:])
+	return subtle.ConstantTimeCompare([]byte(made), []byte(encoded)) == 1
+}
+
+func (PHPass) Outdated(string) bool {
+	return true
+}
+
+// phpassEncode is the little endian base64 of phpass
+func phpassEncode(src []byte) string {
+	var out strings.Builder
+	for i := 0; i < len(src); i += 3 {
+		var v uint
+		n := len(src) - i
+		if n > 3 {
+			n = 3
+		}
+		for j := 0; j < n; j++ {
+			v |= uint(src[i+j]) << (8 * uint(j))
+		}
+		for j := 0; j <= n; j++ {
+			out.WriteByte(phpassItoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	return out.String()
+}
+
+// Salted checks hash:salt hashes of Magento, hash is hex of md5 or
+// sha256 of salt and password and Magento 2 adds :0 or :1 version of
+// them, it only checks imported hashes
+type Salted struct{}
+
+func (Salted) Hash(string) (string, error) {
+	return "", ErrorLegacyHash
+}
+
+func (Salted) Identify(encoded string) bool {
+	_, _, _, ok := parseSalted(encoded)
+	return ok
+}
+
+func (Salted) Valid(encoded string) bool {
+	_, _, _, ok := parseSalted(encoded)
+	return ok
+}
+
+func (Salted) Verify(password, encoded string) bool {
+	digest, salt, key, ok := parseSalted(encoded)
+	if !ok {
+		return false
+	}
+	h := digest()
+	h.Write([]byte(salt + password))
+	return subtle.ConstantTimeCompare(h.Sum(nil), key) == 1
+}
+
+func (Salted) Outdated(string) bool {
+	return true
+}
+
+func parseSalted(encoded string) (func() hash.Hash, string, []byte, bool) {
+	parts := strings.Split(encoded, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, "", nil, false
+	}
+	key, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return nil, "", nil, false
+	}
+	var digest func() hash.Hash
+	switch len(key) {
+	case md5.Size:
+		digest = md5.New
+	case sha256.Size:
+		digest = sha256.New
+	default:
+		return nil, "", nil, false
+	}
+	if len(parts) == 3 {
+		version := map[string]int{"0": md5.Size, "1": sha256.Size}
+		if version[parts[2]] != len(key) {
+			return nil, "", nil, false
+		}
+	}
+	return digest, parts[1], key, true
+}
@@ -0,0 +1,103 @@
+package user
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testHasher keeps tests fast, defaults take a good part of a second
+var testHasher = Argon2id{Time: 1, Memory: 1024, Threads: 1}
+
+func TestHashers(t *testing.T) {
+	legacy, _ := PBKDF2{}.Hash("secret")
+	strong, _ := PBKDF2{Iterations: 100000}.Hash("secret")
+	crypted, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	argon, _ := testHasher.Hash("secret")
+	// stored by MakePassword before hashers
+	stored := "pbkdf2:sha256:50000$abcdefgh$" +
+		"4e5d4c8eacf6a00b13a3de59c38c2bf6af365eec6c2000c9c5e705b0e292083b"
+	for _, hash := range []string{legacy, strong, string(crypted), argon, stored} {
+		if !CheckPassword("secret", hash) {
+			t.Error("password not matched", hash)
+		}
+		if CheckPassword("wrong", hash) {
+			t.Error("wrong password matched", hash)
+		}
+	}
+	// parameters over limits are refused before hashing
+	expensive := []string{
+		"pbkdf2:sha256:5000001$abcdefgh$4e5d",
+		"$argon2id$v=19$m=2097152,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=11,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=17$c2FsdA$a2V5",
+		string(crypted[:4]) + "17" + string(crypted[6:]),
+		"$P$H" + strings.Repeat("a", 30),
+	}
+	for _, hash := range append(expensive, "", "secret", "pbkdf2:sha256:0$a$b", "$argon2id$v=19$m=1,t=0,p=1$a$b") {
+		if CheckPassword("secret", hash) {
+			t.Error("malformed hash matched", hash)
+		}
+	}
+
+	SetHasher(Argon2id{Time: 2, Memory: 1024, Threads: 1})
+	defer SetHasher(testHasher)
+	if !NeedsRehash(legacy) || !NeedsRehash(string(crypted)) || !NeedsRehash(argon) {
+		t.Error("weak hash not rehashed")
+	}
+	current, _ := MakePassword("secret")
+	if NeedsRehash(current) {
+		t.Error("current hash rehashed")
+	}
+	SetHasher(PBKDF2{Iterations: 100000})
+	if !NeedsRehash(legacy) || NeedsRehash(strong) {
+		t.Error("pbkdf2 iterations are not compared")
+	}
+}
+
+func TestValidHash(t *testing.T) {
+	crypted, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	argon, _ := testHasher.Hash("secret")
+	pbkdf, _ := PBKDF2{}.Hash("secret")
+	for hash, valid := range map[string]bool{
+		string(crypted):                         true,
+		argon:                                   true,
+		pbkdf:                                   true,
+		"$P$9IQRaTwmfeRo7ud9Fh4E2PdI0S3r.L0":    true,
+		"d42a0f742ffc1be4e1cc0845c2429c97:salt": true,
+		string(crypted)[:59]:                    false,
+		string(crypted)[:59] + "!":              false,
+		"$2a$03$" + string(crypted)[7:]:         false,
+		"$P$9IQRaTwmfeRo7ud9Fh4E2PdI0S3r.L!":    false,
+		"$P$HIQRaTwmfeRo7ud9Fh4E2PdI0S3r.L0":    false,
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$": false,
+		"pbkdf2:sha256:1000$salt$zz":            false,
+	} {
+		if validHash(hash) != valid {
+			t.Error(hash, "expected valid", valid)
+		}
+	}
+}
+
+func TestRehashOnLogin(t *testing.T) {
+	testPackageinit()
+	u, err := Form{Email: "rehash@test.com", Password: "secret"}.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Password, _ = PBKDF2{}.Hash("secret")
+	if err := u.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (Form{Email: "rehash@test.com", Password: "secret"}).Login(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := new(User)
+	if err := loaded.Load(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !testHasher.Identify(loaded.Password) || !CheckPassword("secret", loaded.Password) {
+		t.Error("password is not upgraded", loaded.Password)
+	}
+}
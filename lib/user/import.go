@@ -0,0 +1,191 @@
+package user
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+)
+
+// ImportRecord is a user exported from another store, Password is its
+// hash there and is kept so user logs in with the same password, it is
+// upgraded by the first login
+type ImportRecord struct {
+	Email     string
+	Fullname  string
+	Call      string
+	Password  string
+	CreatedAt time.Time
+}
+
+// ImportReport of Import, Line is number of record in Errors
+type ImportReport struct {
+	Created    int
+	Duplicates int
+	Errors     []ImportError
+}
+
+type ImportError struct {
+	Line int
+	Err  error
+}
+
+func (e ImportError) Error() string {
+	return fmt.Sprintf("record %d: %v", e.Line, e.Err)
+}
+
+// importColumns maps columns of Magento and WooCommerce exports to
+// fields of ImportRecord
+var importColumns = map[string]string{
+	"email":           "email",
+	"user_email":      "email",
+	"fullname":        "fullname",
+	"name":            "fullname",
+	"display_name":    "fullname",
+	"firstname":       "firstname",
+	"first_name":      "firstname",
+	"lastname":        "lastname",
+	"last_name":       "lastname",
+	"call":            "call",
+	"phone":           "call",
+	"telephone":       "call",
+	"billing_phone":   "call",
+	"password":        "password",
+	"password_hash":   "password",
+	"user_pass":       "password",
+	"created_at":      "created_at",
+	"user_registered": "created_at",
+}
+
+var importTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// ReadCSV reads records of a csv with header, see importColumns
+func ReadCSV(r io.Reader) ([]ImportRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	records := []ImportRecord{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields := map[string]string{}
+		for i, column := range header {
+			if i < len(row) {
+				fields[column] = row[i]
+			}
+		}
+		records = append(records, importRecord(fields))
+	}
+}
+
+// ReadJSON reads records of a json list of objects with keys of
+// importColumns
+func ReadJSON(r io.Reader) ([]ImportRecord, error) {
+	decoder := json.NewDecoder(r)
+	// keeps long phone numbers as they are
+	decoder.UseNumber()
+	objects := []map[string]interface{}{}
+	if err := decoder.Decode(&objects); err != nil {
+		return nil, err
+	}
+	records := make([]ImportRecord, len(objects))
+	for i, object := range objects {
+		fields := map[string]string{}
+		for key, value := range object {
+			if value != nil {
+				fields[key] = fmt.Sprint(value)
+			}
+		}
+		records[i] = importRecord(fields)
+	}
+	return records, nil
+}
+
+func importRecord(fields map[string]string) ImportRecord {
+	values := map[string]string{}
+	for column, value := range fields {
+		field, ok := importColumns[strings.ToLower(strings.TrimSpace(column))]
+		if value = strings.TrimSpace(value); ok && value != "" {
+			values[field] = value
+		}
+	}
+	record := ImportRecord{
+		Email:    values["email"],
+		Fullname: values["fullname"],
+		Call:     values["call"],
+		Password: values["password"],
+	}
+	if record.Fullname == "" {
+		record.Fullname = strings.TrimSpace(values["firstname"] + " " + values["lastname"])
+	}
+	for _, layout := range importTimeLayouts {
+		if t, err := time.Parse(layout, values["created_at"]); err == nil {
+			record.CreatedAt = t
+			break
+		}
+	}
+	return record
+}
+
+// Import saves records as users, records of existing email or call
+// are counted as duplicates and passwords of unknown or malformed hash
+// are refused
+func Import(records []ImportRecord) ImportReport {
+	report := ImportReport{}
+	for i, record := range records {
+		err := importUser(record)
+		switch err {
+		case nil:
+			report.Created++
+		case ErrorDuplicateUser:
+			report.Duplicates++
+		default:
+			report.Errors = append(report.Errors, ImportError{Line: i + 1, Err: err})
+		}
+	}
+	return report
+}
+
+func importUser(record ImportRecord) error {
+	u := &User{
+		Email:      EmailFixer(record.Email),
+		OrginEmail: record.Email,
+		Fullname:   record.Fullname,
+		Call:       CallFixer(record.Call),
+		Password:   record.Password,
+		CreatedAt:  record.CreatedAt,
+	}
+	if u.Email == "" && u.Call == "" {
+		return ErrorImportRecord
+	}
+	if u.Email != "" && !govalidator.IsEmail(u.Email) {
+		return ErrorImportRecord
+	}
+	if u.Password != "" && !validHash(u.Password) {
+		return ErrorUnknownHash
+	}
+	return u.Save()
+}
+
+// validHash reports whether hash is made by one of hashers and passes
+// its parse and parameter limits
+func validHash(hash string) bool {
+	for _, h := range hashers {
+		if h.Identify(hash) {
+			return h.Valid(hash)
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package user
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCallFixer(t *testing.T) {
+	for call, fixed := range map[string]string{
+		"0912 000 0000":    "09120000000",
+		"+98 (912) 000-00": "091200000",
+		"0098912000000":    "0912000000",
+		"۰۹۱۲۰۰۰۰۰۰۰":      "09120000000",
+		"+1 555 0100":      "+15550100",
+		"":                 "",
+	} {
+		if got := CallFixer(call); got != fixed {
+			t.Error(call, "fixed to", got)
+		}
+	}
+}
+
+func TestLegacyHashers(t *testing.T) {
+	for _, c := range []struct {
+		password, hash string
+		match          bool
+	}{
+		// test vector of phpass
+		{"test12345", "$P$9IQRaTwmfeRo7ud9Fh4E2PdI0S3r.L0", true},
+		{"test1234", "$P$9IQRaTwmfeRo7ud9Fh4E2PdI0S3r.L0", false},
+		{"secret", "d42a0f742ffc1be4e1cc0845c2429c97:salt", true},
+		{"Secret", "d42a0f742ffc1be4e1cc0845c2429c97:salt", false},
+		{"secret", "bede90386d450cea8b77b822f8887065e4e5abf132c2f9dccfcc7fbd4cba5e35:salt:1", true},
+		// md5 hash with sha256 version
+		{"secret", "d42a0f742ffc1be4e1cc0845c2429c97:salt:1", false},
+	} {
+		if CheckPassword(c.password, c.hash) != c.match {
+			t.Error("legacy hash", c.hash, "of", c.password, "expected", c.match)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	testPackageinit()
+	existing, _ := Form{Email: "old@gmail.com", Password: "secret"}.Register()
+	crypted, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	bcryptY := "$2y$" + string(crypted)[4:]
+
+	records, err := ReadCSV(strings.NewReader(
+		"email,firstname,lastname,telephone,password_hash,created_at\n" +
+			"Magento@Test.com,Ma,Gento,+98 912 111 1111,d42a0f742ffc1be4e1cc0845c2429c97:salt,2015-03-01 10:00:00\n" +
+			"wp@test.com,Word,Press,,$P$BabcdefghhoF/sggXNwaIB66V9Zcjt.,\n" +
+			"bcrypt@test.com,B,Crypt,,\"" + bcryptY + "\",\n" +
+			"o.l.d@gmail.com,Old,User,,,\n" +
+			",Same,Call,09121111111,,\n" +
+			"unknown@test.com,Un,Known,,sha1$abc$def,\n" +
+			"not an email,No,Mail,,,\n" +
+			"argon@test.com,Ar,Gon,,\"$argon2id$v=19$m=2097152,t=1,p=1$c2FsdA$a2V5\",\n" +
+			"short@test.com,Sh,Ort,,$2a$10$short,\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := Import(records)
+	if report.Created != 3 || report.Duplicates != 2 || len(report.Errors) != 4 {
+		t.Fatal("import report", report)
+	}
+	if report.Errors[0].Line != 6 || report.Errors[0].Err != ErrorUnknownHash ||
+		report.Errors[1].Err != ErrorImportRecord {
+		t.Error("import errors", report.Errors)
+	}
+	// identified hashes which do not parse or are over limits
+	for i, line := range []int{8, 9} {
+		if e := report.Errors[2+i]; e.Line != line || e.Err != ErrorUnknownHash {
+			t.Error("malformed hash imported", e)
+		}
+	}
+
+	u := new(User)
+	if err := u.LoadByMail("magento@test.com"); err != nil {
+		t.Fatal(err)
+	}
+	if u.Fullname != "Ma Gento" || u.Call != "09121111111" || u.CreatedAt.Year() != 2015 {
+		t.Error("imported user", u)
+	}
+	if _, err := new(User).AuthByCall("09121111111", "secret"); err != nil {
+		t.Error("login with md5 salted hash", err)
+	}
+	// imported calls are found in any format
+	if _, err := new(User).AuthByCall("+98 912 111 1111", "secret"); err != nil {
+		t.Error("login with international call", err)
+	}
+	stepped, err := CallForm{Call: "0912 111 1111"}.StepsLogin()
+	if err != nil || stepped.ID != u.ID {
+		t.Fatal("steps login of imported call", err)
+	}
+	result, err := SecureKeyForm{Identifier: "+989121111111", Key: stepped.SecureKey}.Login()
+	if err != nil || result.User.ID != u.ID {
+		t.Error("secure key login of imported call", err)
+	}
+	if _, err := (CallForm{Call: "call me"}).StepsLogin(); err == nil {
+		t.Error("call without digits accepted")
+	}
+	for _, email := range []string{"wp@test.com", "bcrypt@test.com", "magento@test.com"} {
+		result, err := Form{Email: email, Password: "secret"}.Login()
+		if err != nil {
+			t.Fatal("login of imported", email, err)
+		}
+		if !testHasher.Identify(result.User.Password) {
+			t.Error("password of", email, "is not upgraded")
+		}
+	}
+	if err := existing.Load(existing.ID); err != nil || existing.Fullname != "" {
+		t.Error("existing user is changed")
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	records, err := ReadJSON(strings.NewReader(`[
+		{"user_email": "woo@test.com", "display_name": "Woo", "billing_phone": 9121111111,
+		 "user_pass": "$P$BabcdefghhoF/sggXNwaIB66V9Zcjt.", "user_registered": "2019-05-06 07:08:09"},
+		{"email": "json@test.com", "first_name": "J", "last_name": "Son", "phone": null}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Call != "9121111111" || records[0].Fullname != "Woo" ||
+		records[0].CreatedAt.Year() != 2019 || records[1].Fullname != "J Son" {
+		t.Error("json records", records)
+	}
+}
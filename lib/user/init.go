@@ -1,12 +1,19 @@
 package user
 
-import "github.com/jeyem/mogo"
+import (
+	"github.com/jeyem/gocommerce/util/repository"
+	"github.com/jeyem/mogo"
+)
 
 var (
-	db *mogo.DB
+	db repository.Repository
 )
 
 func Register(database *mogo.DB) {
-	db = database
+	RegisterRepository(repository.NewMongo(database))
+}
 
+// RegisterRepository is Register with any storage like repository.NewMemory
+func RegisterRepository(repo repository.Repository) {
+	db = repo
 }
@@ -0,0 +1,381 @@
+package user
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeyem/gocommerce/util/random"
+	"github.com/jeyem/gocommerce/util/repository"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	defaultFreeAttempts = 3
+	defaultBackoff      = time.Second
+	defaultMaxBackoff   = 15 * time.Minute
+	defaultWindow       = time.Hour
+	defaultMaxFailures  = 10
+	defaultIPFailures   = 100
+	defaultKeyFailures  = 5
+	defaultLockDuration = time.Hour
+)
+
+// limiter guards password and secure key logins, see SetLimiter
+var limiter = &Limiter{Store: NewMemoryAttempts()}
+
+// Limiter counts failed logins per identifier and per IP. After
+// FreeAttempts failures each attempt waits Backoff doubled by every
+// failure up to MaxBackoff, secure key is invalidated after
+// KeyFailures and account is locked for LockDuration after MaxFailures.
+// Failures older than Window are forgotten
+type Limiter struct {
+	Store        AttemptStore
+	FreeAttempts int
+	Backoff      time.Duration
+	MaxBackoff   time.Duration
+	Window       time.Duration
+	MaxFailures  int
+	IPFailures   int
+	KeyFailures  int
+	LockDuration time.Duration
+	// OnLock is called with unlock key when an account gets locked,
+	// by default the key is sent to user with MessageUnlock
+	OnLock func(u *User, key string)
+}
+
+// SetLimiter replaces the default in memory limiter, nil disables limits
+func SetLimiter(l *Limiter) {
+	limiter = l
+}
+
+// Attempts is failures of a key like id:email or ip:1.2.3.4
+type Attempts struct {
+	ID       bson.ObjectId `bson:"_id,omitempty"`
+	Key      string        `bson:"key"`
+	Failures int           `bson:"failures"`
+	Last     time.Time     `bson:"last"`
+}
+
+func (Attempts) Meta() []mgo.Index {
+	return []mgo.Index{
+		{Key: []string{"key"}, Unique: true},
+		{Key: []string{"last"}},
+	}
+}
+
+// AttemptStore keeps failure counters, Get returns zero Attempts
+// for unknown keys
+type AttemptStore interface {
+	Get(key string) (Attempts, error)
+	Fail(key string) (Attempts, error)
+	Reset(key string) error
+}
+
+type memoryAttempts struct {
+	mu       sync.Mutex
+	attempts map[string]Attempts
+}
+
+func NewMemoryAttempts() AttemptStore {
+	return &memoryAttempts{attempts: map[string]Attempts{}}
+}
+
+func (m *memoryAttempts) Get(key string) (Attempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.attempts[key], nil
+}
+
+func (m *memoryAttempts) Fail(key string) (Attempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a := m.attempts[key]
+	a.Key = key
+	a.Failures++
+	a.Last = time.Now()
+	m.attempts[key] = a
+	return a, nil
+}
+
+func (m *memoryAttempts) Reset(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
+
+// mongoAttempts shares counters between instances through the
+// registered database
+type mongoAttempts struct{}
+
+func NewMongoAttempts() AttemptStore {
+	return mongoAttempts{}
+}
+
+func (mongoAttempts) Get(key string) (Attempts, error) {
+	a := Attempts{}
+	err := db.Where(bson.M{"key": key}).Find(&a)
+	if err == repository.ErrNotFound {
+		return Attempts{Key: key}, nil
+	}
+	return a, err
+}
+
+func (s mongoAttempts) Fail(key string) (Attempts, error) {
+	if err := db.Upsert(&Attempts{}, bson.M{"key": key}, bson.M{
+		"$inc": bson.M{"failures": 1},
+		"$set": bson.M{"last": time.Now()},
+	}); err != nil {
+		return Attempts{}, err
+	}
+	return s.Get(key)
+}
+
+func (mongoAttempts) Reset(key string) error {
+	_, err := db.Remove(&Attempts{}, bson.M{"key": key})
+	return err
+}
+
+// Locked reports whether account is locked after too many failures
+func (u *User) Locked() bool {
+	return time.Now().Before(u.LockedUntil)
+}
+
+// Lock locks account for d and returns key which unlocks it
+func (u *User) Lock(d time.Duration) (string, error) {
+	key := random.Hex(16)
+	u.LockedUntil = time.Now().Add(d)
+	u.UnlockKey = hashToken(key)
+	return key, u.Update()
+}
+
+// Unlock clears lock and failures of account
+func (u *User) Unlock() error {
+	u.LockedUntil = time.Time{}
+	u.UnlockKey = ""
+	u.resetAttempts()
+	return u.Update()
+}
+
+// resetAttempts clears failures of every identifier of u
+func (u *User) resetAttempts() {
+	if limiter == nil {
+		return
+	}
+	for _, identifier := range []string{u.Email, u.Call, u.secondFactorKey()} {
+		if identifier != "" {
+			limiter.reset(identifier, "")
+		}
+	}
+}
+
+// UnlockByKey unlocks account of identifier with key given by Lock
+func UnlockByKey(identifier, key string) (*User, error) {
+	identifier = fixIdentifier(identifier)
+	u := new(User)
+	if err := db.Where(bson.M{
+		"$or":        []bson.M{{"email": identifier}, {"call": identifier}},
+		"unlock_key": hashToken(key),
+	}).Find(u); err != nil {
+		return nil, ErrorUnlockKey
+	}
+	return u, u.Unlock()
+}
+
+// guard runs auth unless identifier or ip wait for backoff, failures
+// are counted and counters are reset by login once all factors pass
+func (l *Limiter) guard(identifier, ip string, auth func() error) error {
+	if l == nil {
+		return auth()
+	}
+	for _, key := range l.keys(identifier, ip) {
+		waiting, err := l.waiting(key)
+		if err != nil {
+			return err
+		}
+		if waiting {
+			return ErrorTooManyAttempts
+		}
+	}
+	err := auth()
+	if err == nil || err == ErrorLocked {
+		return err
+	}
+	for _, key := range l.keys(identifier, ip) {
+		if strings.HasPrefix(key, "ip:") {
+			l.fail(key)
+			continue
+		}
+		if a := l.fail(key); a.Failures >= l.maxFailures() {
+			l.lock(identifier)
+		}
+	}
+	return err
+}
+
+// throttle counts every call of key as a failure and refuses calls
+// waiting for backoff, for requests which can not fail like sending
+// reset tokens
+func (l *Limiter) throttle(key string) error {
+	if l == nil {
+		return nil
+	}
+	waiting, err := l.waiting(key)
+	if err != nil {
+		return err
+	}
+	if waiting {
+		return ErrorTooManyAttempts
+	}
+	l.fail(key)
+	return nil
+}
+
+// failKey counts a wrong secure key and reports whether key should
+// be invalidated
+func (l *Limiter) failKey(identifier string) bool {
+	if l == nil {
+		return false
+	}
+	a := l.fail("key:" + identifier)
+	if a.Failures < l.keyFailures() {
+		return false
+	}
+	l.Store.Reset("key:" + identifier)
+	return true
+}
+
+// waiting reports whether key waits for backoff, counters which can
+// not be read are errors so a failing store does not disable limits
+func (l *Limiter) waiting(key string) (bool, error) {
+	a, err := l.get(key)
+	if err != nil {
+		return false, err
+	}
+	// addresses are shared by many users, they only wait for
+	// MaxBackoff after IPFailures
+	if strings.HasPrefix(key, "ip:") {
+		return a.Failures >= l.ipFailures() && time.Since(a.Last) < l.maxBackoff(), nil
+	}
+	free := l.FreeAttempts
+	if free <= 0 {
+		free = defaultFreeAttempts
+	}
+	if a.Failures < free {
+		return false, nil
+	}
+	wait := l.backoff()
+	for i := free; i < a.Failures && wait < l.maxBackoff(); i++ {
+		wait *= 2
+	}
+	if wait > l.maxBackoff() {
+		wait = l.maxBackoff()
+	}
+	return time.Since(a.Last) < wait, nil
+}
+
+func (l *Limiter) get(key string) (Attempts, error) {
+	a, err := l.Store.Get(key)
+	if err != nil {
+		return Attempts{Key: key}, err
+	}
+	if time.Since(a.Last) > l.window() {
+		return Attempts{Key: key}, nil
+	}
+	return a, nil
+}
+
+func (l *Limiter) fail(key string) Attempts {
+	if a, err := l.Store.Get(key); err == nil && a.Failures > 0 &&
+		time.Since(a.Last) > l.window() {
+		l.Store.Reset(key)
+	}
+	a, _ := l.Store.Fail(key)
+	return a
+}
+
+func (l *Limiter) reset(identifier, ip string) {
+	for _, key := range l.keys(identifier, ip) {
+		l.Store.Reset(key)
+	}
+	l.Store.Reset("key:" + identifier)
+}
+
+func (l *Limiter) lock(identifier string) {
+	query := bson.M{"$or": []bson.M{{"email": identifier}, {"call": identifier}}}
+	// second factor failures are counted by user id
+	if id := strings.TrimPrefix(identifier, secondFactorPrefix); id != identifier &&
+		bson.IsObjectIdHex(id) {
+		query = bson.M{"_id": bson.ObjectIdHex(id)}
+	}
+	u := new(User)
+	if err := db.Where(query).Find(u); err != nil || u.Locked() {
+		return
+	}
+	d := l.LockDuration
+	if d <= 0 {
+		d = defaultLockDuration
+	}
+	key, err := u.Lock(d)
+	if err != nil {
+		return
+	}
+	if l.OnLock != nil {
+		l.OnLock(u, key)
+		return
+	}
+	u.notifyAny(MessageUnlock, map[string]interface{}{"Key": key})
+}
+
+func (l *Limiter) keys(identifier, ip string) []string {
+	keys := []string{"id:" + identifier}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	return keys
+}
+
+func (l *Limiter) backoff() time.Duration {
+	if l.Backoff > 0 {
+		return l.Backoff
+	}
+	return defaultBackoff
+}
+
+func (l *Limiter) maxBackoff() time.Duration {
+	if l.MaxBackoff > 0 {
+		return l.MaxBackoff
+	}
+	return defaultMaxBackoff
+}
+
+func (l *Limiter) window() time.Duration {
+	if l.Window > 0 {
+		return l.Window
+	}
+	return defaultWindow
+}
+
+func (l *Limiter) maxFailures() int {
+	if l.MaxFailures > 0 {
+		return l.MaxFailures
+	}
+	return defaultMaxFailures
+}
+
+func (l *Limiter) ipFailures() int {
+	if l.IPFailures > 0 {
+		return l.IPFailures
+	}
+	return defaultIPFailures
+}
+
+func (l *Limiter) keyFailures() int {
+	if l.KeyFailures > 0 {
+		return l.KeyFailures
+	}
+	return defaultKeyFailures
+}
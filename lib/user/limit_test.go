@@ -0,0 +1,132 @@
+package user
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jeyem/gocommerce/util/repository"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func testLimiter(t *testing.T, l *Limiter) {
+	previous := limiter
+	SetLimiter(l)
+	t.Cleanup(func() { SetLimiter(previous) })
+}
+
+func TestBackoff(t *testing.T) {
+	testPackageinit()
+	testLimiter(t, &Limiter{Store: NewMongoAttempts(), FreeAttempts: 2, IPFailures: 3, Backoff: time.Hour})
+	form := Form{Email: "backoff@test.com", Password: "secret"}
+	if _, err := form.Register(); err != nil {
+		t.Fatal(err)
+	}
+	wrong := Form{Email: form.Email, Password: "wrong", IP: "10.0.0.1"}
+	for i := 0; i < 2; i++ {
+		if _, err := wrong.Login(); err != ErrorUserPass {
+			t.Fatal("failure", i, err)
+		}
+	}
+	if _, err := form.Login(); err != ErrorTooManyAttempts {
+		t.Error("login during backoff", err)
+	}
+	// other identifiers from same address are not blocked yet
+	other := Form{Email: "other@test.com", Password: "wrong", IP: "10.0.0.1"}
+	if _, err := other.Login(); err != ErrorUserPass {
+		t.Error("other identifier", err)
+	}
+	if _, err := other.Login(); err != ErrorTooManyAttempts {
+		t.Error("address is not counted", err)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	testPackageinit()
+	var unlockKey string
+	testLimiter(t, &Limiter{
+		Store: NewMemoryAttempts(), FreeAttempts: 10, MaxFailures: 3,
+		OnLock: func(u *User, key string) { unlockKey = key },
+	})
+	form := Form{Email: "lock@test.com", Password: "secret"}
+	if _, err := form.Register(); err != nil {
+		t.Fatal(err)
+	}
+	wrong := Form{Email: form.Email, Password: "wrong"}
+	for i := 0; i < 3; i++ {
+		wrong.Login()
+	}
+	if unlockKey == "" {
+		t.Fatal("account is not locked")
+	}
+	if _, err := wrong.Login(); err != ErrorUserPass {
+		t.Error("lock is told without password", err)
+	}
+	if _, err := form.Login(); err != ErrorLocked {
+		t.Error("login of locked account", err)
+	}
+	if _, err := (UnlockForm{Identifier: form.Email, Key: "wrong"}).Unlock(); err != ErrorUnlockKey {
+		t.Error("unlocked with wrong key", err)
+	}
+	if _, err := (UnlockForm{Identifier: form.Email, Key: unlockKey}).Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := form.Login(); err != nil {
+		t.Error("login after unlock", err)
+	}
+}
+
+func TestSecureKeyInvalidation(t *testing.T) {
+	testPackageinit()
+	testLimiter(t, &Limiter{Store: NewMemoryAttempts(), FreeAttempts: 10, KeyFailures: 3})
+	u, err := CallForm{Call: "09121111111"}.StepsLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := (SecureKeyForm{Identifier: u.Call, Key: "wrong"}).Login(); err == nil {
+			t.Fatal("login with wrong key")
+		}
+	}
+	if _, err := (SecureKeyForm{Identifier: u.Call, Key: u.SecureKey}).Login(); err == nil {
+		t.Error("secure key is not invalidated")
+	}
+}
+
+// failingFinds fails every Find
+type failingFinds struct {
+	repository.Repository
+}
+
+func (r failingFinds) Where(query bson.M) repository.Query {
+	return failingQuery{r.Repository.Where(query)}
+}
+
+type failingQuery struct {
+	repository.Query
+}
+
+func (failingQuery) Find(interface{}) error {
+	return errors.New("find failed")
+}
+
+func TestAttemptStoreErrors(t *testing.T) {
+	testPackageinit()
+	store := NewMongoAttempts()
+	if a, err := store.Get("id:new@test.com"); err != nil || a.Failures != 0 {
+		t.Error("unknown key", a, err)
+	}
+	RegisterRepository(failingFinds{repository.NewMemory()})
+	if _, err := store.Get("id:new@test.com"); err == nil {
+		t.Error("store error is swallowed")
+	}
+	l := &Limiter{Store: store}
+	called := false
+	if err := l.guard("new@test.com", "", func() error {
+		called = true
+		return nil
+	}); err == nil || called {
+		t.Error("login is allowed without counters", err)
+	}
+}
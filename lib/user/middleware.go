@@ -0,0 +1,126 @@
+package user
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// SessionCookie holds access token for browsers
+	SessionCookie = "session"
+	// CSRFCookie is set by clients next to SessionCookie and sent back
+	// in CSRFHeader by requests which change state
+	CSRFCookie = "csrf"
+	CSRFHeader = "X-CSRF-Token"
+
+	contextUser   = "user"
+	contextClaims = "claims"
+)
+
+// Authenticate loads user of bearer token or session cookie into
+// context, requests without a valid token or of a locked user get 401.
+// Session cookie of unsafe methods needs CSRFHeader same as CSRFCookie
+func Authenticate(tokens *Tokens) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token := extractToken(c)
+			if token == "" {
+				return unauthorized(c, ErrorTokenInvalid)
+			}
+			u, claims, err := tokens.VerifyUser(token)
+			if err != nil {
+				return unauthorized(c, err)
+			}
+			if u.Locked() {
+				return unauthorized(c, ErrorLocked)
+			}
+			c.Set(contextUser, u)
+			c.Set(contextClaims, claims)
+			return next(c)
+		}
+	}
+}
+
+// FromContext is user set by Authenticate, nil when not authenticated
+func FromContext(c echo.Context) *User {
+	u, _ := c.Get(contextUser).(*User)
+	return u
+}
+
+// ClaimsFromContext is access token claims set by Authenticate
+func ClaimsFromContext(c echo.Context) *Claims {
+	claims, _ := c.Get(contextClaims).(*Claims)
+	return claims
+}
+
+// Require allows users passing allowed, use after Authenticate
+func Require(allowed func(u *User) bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			u := FromContext(c)
+			if u == nil {
+				return unauthorized(c, ErrorTokenInvalid)
+			}
+			if !allowed(u) {
+				return forbidden(c)
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireRole allows users having one of roles
+func RequireRole(roles ...string) echo.MiddlewareFunc {
+	return Require(func(u *User) bool {
+		for _, role := range roles {
+			if u.Role == role {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// RequirePermission allows users whose role is granted permission,
+// handlers check ownership of the resource with Can
+func RequirePermission(permission string) echo.MiddlewareFunc {
+	return Require(func(u *User) bool {
+		return u.HasPermission(permission)
+	})
+}
+
+func extractToken(c echo.Context) string {
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	cookie, err := c.Cookie(SessionCookie)
+	if err != nil {
+		return ""
+	}
+	switch c.Request().Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return cookie.Value
+	}
+	// browsers send cookies of cross site requests too, only pages
+	// of the site can read the csrf cookie and copy it to header
+	csrf, err := c.Cookie(CSRFCookie)
+	header := c.Request().Header.Get(CSRFHeader)
+	if err != nil || csrf.Value == "" ||
+		subtle.ConstantTimeCompare([]byte(csrf.Value), []byte(header)) != 1 {
+		return ""
+	}
+	return cookie.Value
+}
+
+func unauthorized(c echo.Context, err error) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+	return c.JSON(http.StatusUnauthorized, echo.Map{"error": err.Error()})
+}
+
+func forbidden(c echo.Context) error {
+	return c.JSON(http.StatusForbidden, echo.Map{"error": ErrorForbidden.Error()})
+}
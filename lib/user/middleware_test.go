@@ -0,0 +1,97 @@
+package user
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func TestMiddleware(t *testing.T) {
+	testPackageinit()
+	u := testUser(t)
+	tokens := &Tokens{Secret: []byte("secret")}
+	session, err := tokens.Issue(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Grant("admin", "orders:refund")
+
+	e := echo.New()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, FromContext(c).ID.Hex())
+	}
+	auth := Authenticate(tokens)
+	e.GET("/me", ok, auth)
+	e.POST("/me", ok, auth)
+	e.GET("/admin", ok, auth, RequireRole("admin"))
+	e.GET("/seller", ok, auth, RequireRole("seller"))
+	e.GET("/refund", ok, auth, RequirePermission("orders:refund"))
+	e.GET("/delete", ok, auth, RequirePermission("files:delete:any"))
+
+	tests := []struct {
+		method string
+		path   string
+		bearer string
+		cookie string
+		csrf   string
+		status int
+	}{
+		{http.MethodGet, "/me", "", "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/me", "wrong", "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/me", session.AccessToken, "", "", http.StatusOK},
+		{http.MethodGet, "/me", "", session.AccessToken, "", http.StatusOK},
+		{http.MethodPost, "/me", session.AccessToken, "", "", http.StatusOK},
+		{http.MethodPost, "/me", "", session.AccessToken, "", http.StatusUnauthorized},
+		{http.MethodPost, "/me", "", session.AccessToken, "csrf", http.StatusOK},
+		{http.MethodGet, "/admin", session.AccessToken, "", "", http.StatusOK},
+		{http.MethodGet, "/seller", session.AccessToken, "", "", http.StatusForbidden},
+		{http.MethodGet, "/refund", session.AccessToken, "", "", http.StatusOK},
+		{http.MethodGet, "/delete", session.AccessToken, "", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.bearer != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+test.bearer)
+		}
+		if test.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: SessionCookie, Value: test.cookie})
+		}
+		if test.csrf != "" {
+			req.AddCookie(&http.Cookie{Name: CSRFCookie, Value: test.csrf})
+			req.Header.Set(CSRFHeader, test.csrf)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Error(test.path, "got", rec.Code, "want", test.status, rec.Body.String())
+		}
+		if rec.Code == http.StatusOK && rec.Body.String() != u.ID.Hex() {
+			t.Error(test.path, "context user", rec.Body.String())
+		}
+	}
+
+	// csrf header must match the cookie
+	req := httptest.NewRequest(http.MethodPost, "/me", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.AccessToken})
+	req.AddCookie(&http.Cookie{Name: CSRFCookie, Value: "csrf"})
+	req.Header.Set(CSRFHeader, "other")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Error("csrf header of another value got", rec.Code)
+	}
+
+	if _, err := u.Lock(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+session.AccessToken)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Error("locked user got", rec.Code)
+	}
+}
@@ -0,0 +1,287 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	ChannelSMS   = "sms"
+	ChannelEmail = "email"
+
+	MessageSecureKey       = "secure_key"
+	MessageUnlock          = "unlock"
+	MessagePasswordReset   = "password_reset"
+	MessagePasswordChanged = "password_changed"
+	MessageVerifyEmail     = "verify_email"
+	MessageEmailChanged    = "email_changed"
+
+	DeliverySent   = "sent"
+	DeliveryFailed = "failed"
+
+	DefaultLocale = "en"
+)
+
+var (
+	notifiers   = map[string]Notifier{}
+	notifiersMu sync.RWMutex
+
+	// templates of messages per locale and kind, executed with data
+	// given to Notify
+	templates = map[string]map[string]Template{
+		DefaultLocale: {
+			MessageSecureKey: {
+				Subject: "Your login code",
+				Body:    "Your login code is {{.Key}}, it expires in {{.Minutes}} minutes.",
+			},
+			MessageUnlock: {
+				Subject: "Your account is locked",
+				Body:    "Your account is locked after too many failed logins, unlock it with key {{.Key}}",
+			},
+			MessagePasswordReset: {
+				Subject: "Reset your password",
+				Body:    "Use {{.Token}} to set a new password in {{.Minutes}} minutes, ignore this if you did not ask for it.",
+			},
+			MessagePasswordChanged: {
+				Subject: "Your password is changed",
+				Body:    "Your password is changed and you are logged out of all devices.",
+			},
+			MessageVerifyEmail: {
+				Subject: "Confirm your email",
+				Body:    "Confirm {{.Email}} with {{.Token}} in {{.Hours}} hours.",
+			},
+			MessageEmailChanged: {
+				Subject: "Your email is changed",
+				Body:    "Email of your account is changed to {{.Email}}.",
+			},
+		},
+	}
+	templatesMu sync.RWMutex
+)
+
+// Notifier delivers a message to a phone number or email address
+type Notifier interface {
+	Send(to string, m Message) error
+}
+
+type Message struct {
+	Subject string
+	Body    string
+}
+
+type Template struct {
+	Subject string
+	Body    string
+}
+
+// Delivery records a notification for support, body is not kept as
+// messages carry login codes
+type Delivery struct {
+	ID        bson.ObjectId `bson:"_id,omitempty"`
+	User      bson.ObjectId `bson:"user"`
+	Channel   string        `bson:"channel"`
+	Kind      string        `bson:"kind"`
+	To        string        `bson:"to"`
+	Status    string        `bson:"status"`
+	Error     string        `bson:"error,omitempty"`
+	CreatedAt time.Time     `bson:"created_at"`
+}
+
+func (Delivery) Meta() []mgo.Index {
+	return []mgo.Index{
+		{Key: []string{"user", "created_at"}},
+	}
+}
+
+// SetNotifier sets notifier of channel, messages of channels without
+// notifier are not sent and nil removes notifier
+func SetNotifier(channel string, n Notifier) {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	if n == nil {
+		delete(notifiers, channel)
+		return
+	}
+	notifiers[channel] = n
+}
+
+// SetTemplate adds or replaces template of kind for locale
+func SetTemplate(locale, kind string, t Template) error {
+	for _, text := range []string{t.Subject, t.Body} {
+		if _, err := template.New(kind).Parse(text); err != nil {
+			return err
+		}
+	}
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	if templates[locale] == nil {
+		templates[locale] = map[string]Template{}
+	}
+	templates[locale][kind] = t
+	return nil
+}
+
+// Notify sends message of kind to u through channel in locale of u,
+// every try is recorded as a Delivery
+func (u *User) Notify(channel, kind string, data interface{}) error {
+	notifiersMu.RLock()
+	n, ok := notifiers[channel]
+	notifiersMu.RUnlock()
+	if !ok {
+		return nil
+	}
+	to := u.Call
+	if channel == ChannelEmail {
+		to = u.OrginEmail
+		if to == "" {
+			to = u.Email
+		}
+	}
+	if to == "" {
+		return ErrorNoAddress
+	}
+	m, err := render(u.Locale, kind, data)
+	if err == nil {
+		err = n.Send(to, m)
+	}
+	d := &Delivery{
+		User: u.ID, Channel: channel, Kind: kind, To: to,
+		Status: DeliverySent, CreatedAt: time.Now(),
+	}
+	if err != nil {
+		d.Status = DeliveryFailed
+		d.Error = err.Error()
+	}
+	if created := db.Create(d); err == nil {
+		err = created
+	}
+	return err
+}
+
+// notifyAny sends message by email or by sms when user has no email
+func (u *User) notifyAny(kind string, data interface{}) error {
+	if u.Email != "" {
+		return u.Notify(ChannelEmail, kind, data)
+	}
+	return u.Notify(ChannelSMS, kind, data)
+}
+
+// LoadDeliveries lists notifications of user, latest first
+func LoadDeliveries(user bson.ObjectId, limit, page int) (deliveries []Delivery) {
+	db.Where(bson.M{"user": user}).Sort("-created_at", "-_id").
+		Paginate(limit, page).Find(&deliveries)
+	return deliveries
+}
+
+func render(locale, kind string, data interface{}) (Message, error) {
+	templatesMu.RLock()
+	t, ok := templates[locale][kind]
+	if !ok {
+		t, ok = templates[DefaultLocale][kind]
+	}
+	templatesMu.RUnlock()
+	if !ok {
+		return Message{}, ErrorNoTemplate
+	}
+	subject, err := execute(kind, t.Subject, data)
+	if err != nil {
+		return Message{}, err
+	}
+	body, err := execute(kind, t.Body, data)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Subject: subject, Body: body}, nil
+}
+
+func execute(name, text string, data interface{}) (string, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// SMS posts messages as json {"to", "from", "text"} to URL of an
+// SMS gateway with APIKey as bearer token
+type SMS struct {
+	URL    string
+	APIKey string
+	From   string
+	Client *http.Client
+}
+
+func (s *SMS) Send(to string, m Message) error {
+	body, err := json.Marshal(map[string]string{
+		"to": to, "from": s.From, "text": m.Body,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.APIKey)
+	}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("sms: gateway responded %s", res.Status)
+	}
+	return nil
+}
+
+// Email sends plain text messages through SMTP server at Addr,
+// Username enables PLAIN auth which needs TLS except on localhost
+type Email struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (e *Email) Send(to string, m Message) error {
+	var auth smtp.Auth
+	if e.Username != "" {
+		host, _, _ := net.SplitHostPort(e.Addr)
+		auth = smtp.PlainAuth("", e.Username, e.Password, host)
+	}
+	if strings.ContainsAny(to, "\r\n") {
+		return ErrorNoAddress
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", e.From)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+	return smtp.SendMail(e.Addr, auth, e.From, []string{to}, b.Bytes())
+}
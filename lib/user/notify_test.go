@@ -0,0 +1,138 @@
+package user
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeSMTP accepts one session per connection and sends each
+// received message body to messages
+func fakeSMTP(t *testing.T) (addr string, messages chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	messages = make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, messages)
+		}
+	}()
+	return l.Addr().String(), messages
+}
+
+func serveSMTP(conn net.Conn, messages chan string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost fake")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case command == "DATA":
+			reply("354 end with .")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			messages <- data.String()
+			reply("250 ok")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestNotifyEmail(t *testing.T) {
+	testPackageinit()
+	addr, messages := fakeSMTP(t)
+	SetNotifier(ChannelEmail, &Email{Addr: addr, From: "shop@test.com"})
+	t.Cleanup(func() { SetNotifier(ChannelEmail, nil) })
+	if err := SetTemplate("fa", MessageSecureKey, Template{
+		Subject: "کد ورود", Body: "کد ورود شما {{.Key}}",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	u := &User{Email: "notify@test.com", OrginEmail: "Notify@test.com", Locale: "fa"}
+	if err := u.Save(); err != nil {
+		t.Fatal(err)
+	}
+	u, err := MailForm{Email: u.Email}.StepsLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := <-messages
+	if !strings.Contains(message, "To: Notify@test.com") ||
+		!strings.Contains(message, "کد ورود شما "+u.SecureKey) {
+		t.Error("message", message)
+	}
+	deliveries := LoadDeliveries(u.ID, 10, 1)
+	if len(deliveries) != 1 || deliveries[0].Status != DeliverySent ||
+		deliveries[0].Kind != MessageSecureKey {
+		t.Error("deliveries", deliveries)
+	}
+}
+
+func TestNotifySMS(t *testing.T) {
+	testPackageinit()
+	received := make(chan map[string]string, 1)
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail || r.Header.Get("Authorization") != "Bearer key" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	}))
+	defer ts.Close()
+	SetNotifier(ChannelSMS, &SMS{URL: ts.URL, APIKey: "key", From: "shop"})
+	t.Cleanup(func() { SetNotifier(ChannelSMS, nil) })
+
+	u, err := CallForm{Call: "09122222222"}.StepsLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := <-received
+	if body["to"] != u.Call || !strings.Contains(body["text"], u.SecureKey) {
+		t.Error("sms", body)
+	}
+
+	fail = true
+	if _, err := (CallForm{Call: u.Call}).StepsLogin(); err == nil {
+		t.Error("failed gateway is not reported")
+	}
+	deliveries := LoadDeliveries(u.ID, 10, 1)
+	if len(deliveries) != 2 || deliveries[0].Status != DeliveryFailed ||
+		deliveries[1].Status != DeliverySent {
+		t.Error("deliveries", deliveries)
+	}
+}
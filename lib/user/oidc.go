@@ -0,0 +1,462 @@
+package user
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeyem/gocommerce/util/random"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	GoogleIssuer = "https://accounts.google.com"
+	// google also signs id tokens with issuer without scheme
+	googleIssuerHost = "accounts.google.com"
+
+	purposeOIDC = "oidc:"
+	oidcTTL     = 10 * time.Minute
+	// clock skew allowed between provider and us
+	oidcLeeway = time.Minute
+	// keys are fetched again for unknown kid at most once a minute
+	jwksRefetch = time.Minute
+)
+
+// Provider logs users in with OpenID Connect authorization code flow
+// and PKCE. Endpoints are discovered from Issuer when not set
+type Provider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	AuthURL      string
+	TokenURL     string
+	JWKSURL      string
+	Client       *http.Client
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	fetching *keysFetch
+}
+
+// Google is Provider of Google accounts, its users get GoogleID
+func Google(clientID, clientSecret, redirectURL string) *Provider {
+	return &Provider{
+		Name:         "google",
+		Issuer:       GoogleIssuer,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+	}
+}
+
+// IDClaims are claims of an ID token used for login
+type IDClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	AuthorizedBy  string   `json:"azp"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+	Locale        string   `json:"locale"`
+}
+
+// audience is aud claim which is a string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// AuthCodeURL starts a login, redirect user to the returned url. State
+// and PKCE verifier are kept in database until Callback
+func (p *Provider) AuthCodeURL() (string, error) {
+	endpoints, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	// states of logins which never come back are not used up
+	if err := purgeTokens(purposeOIDC + p.Name); err != nil {
+		return "", err
+	}
+	state := random.URLSafe(refreshLength)
+	verifier := random.URLSafe(refreshLength)
+	now := time.Now()
+	if err := db.Create(&OneTimeToken{
+		Purpose:   purposeOIDC + p.Name,
+		Hash:      hashToken(state),
+		Value:     verifier,
+		CreatedAt: now,
+		ExpiresAt: now.Add(oidcTTL),
+	}); err != nil {
+		return "", err
+	}
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonceOf(verifier)},
+		"code_challenge":        {challengeOf(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(endpoints.AuthURL, "?") {
+		sep = "&"
+	}
+	return endpoints.AuthURL + sep + q.Encode(), nil
+}
+
+// Callback finishes login with state and code of redirect. Users are
+// found by provider identity, else linked by verified email or created,
+// users with TOTP enabled get a challenge for SecondFactorForm
+func (p *Provider) Callback(state, code string) (*LoginResult, error) {
+	t, err := useToken(purposeOIDC+p.Name, state)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	idToken, err := p.exchange(endpoints.TokenURL, code, t.Value)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := p.VerifyIDToken(idToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != nonceOf(t.Value) {
+		return nil, ErrorTokenInvalid
+	}
+	return p.login(claims)
+}
+
+// VerifyIDToken checks signature of token with keys of provider and
+// its issuer, audience and expiry
+func (p *Provider) VerifyIDToken(token string) (*IDClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrorTokenInvalid
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrorTokenInvalid
+	}
+	signature, err := tokenEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrorTokenInvalid
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" ||
+			rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) != nil {
+			return nil, ErrorTokenInvalid
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(signature[:32]),
+				new(big.Int).SetBytes(signature[32:])) {
+			return nil, ErrorTokenInvalid
+		}
+	default:
+		return nil, ErrorTokenInvalid
+	}
+	claims := new(IDClaims)
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, ErrorTokenInvalid
+	}
+	if !p.issuedBy(claims.Issuer) || claims.Subject == "" {
+		return nil, ErrorTokenInvalid
+	}
+	found := false
+	for _, aud := range claims.Audience {
+		found = found || aud == p.ClientID
+	}
+	if !found || (len(claims.Audience) > 1 && claims.AuthorizedBy != p.ClientID) {
+		return nil, ErrorTokenInvalid
+	}
+	if time.Now().Add(-oidcLeeway).Unix() >= claims.ExpiresAt {
+		return nil, ErrorTokenExpired
+	}
+	return claims, nil
+}
+
+func (p *Provider) login(claims *IDClaims) (*LoginResult, error) {
+	identity := p.Name + ":" + claims.Subject
+	u := new(User)
+	if err := db.Where(bson.M{"identities": identity}).Find(u); err == nil {
+		return u.login()
+	}
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, ErrorProviderEmail
+	}
+	if err := u.LoadByMail(EmailFixer(claims.Email)); err == nil {
+		if !u.EmailVerified {
+			// whoever registered the unverified address may know its
+			// password, the inbox owner takes the account over clean
+			u.Password = ""
+			if err := u.revokeSessions(); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		u = &User{
+			Email:      EmailFixer(claims.Email),
+			OrginEmail: claims.Email,
+			Fullname:   claims.Name,
+			Locale:     claims.Locale,
+		}
+	}
+	u.EmailVerified = true
+	u.Identities = append(u.Identities, identity)
+	if isGoogle(p.Issuer) {
+		u.GoogleID = claims.Subject
+	}
+	if err := u.Save(); err != nil {
+		return nil, err
+	}
+	return u.login()
+}
+
+func (p *Provider) exchange(tokenURL, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"code_verifier": {verifier},
+	}
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+	res, err := p.client().PostForm(tokenURL, form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc: token endpoint responded %s", res.Status)
+	}
+	body := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.IDToken == "" {
+		return "", ErrorTokenInvalid
+	}
+	return body.IDToken, nil
+}
+
+// endpoints of a provider copied under its lock
+type endpoints struct {
+	AuthURL, TokenURL, JWKSURL string
+}
+
+// discover fills endpoints from openid configuration of Issuer and
+// returns them
+func (p *Provider) discover() (endpoints, error) {
+	p.mu.Lock()
+	current := endpoints{p.AuthURL, p.TokenURL, p.JWKSURL}
+	p.mu.Unlock()
+	if current.AuthURL != "" && current.TokenURL != "" && current.JWKSURL != "" {
+		return current, nil
+	}
+	config := struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JWKSURL  string `json:"jwks_uri"`
+	}{}
+	if err := p.getJSON(strings.TrimSuffix(p.Issuer, "/")+
+		"/.well-known/openid-configuration", &config); err != nil {
+		return current, err
+	}
+	if !p.issuedBy(config.Issuer) {
+		return current, fmt.Errorf("oidc: issuer %s does not match %s", config.Issuer, p.Issuer)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.AuthURL = config.AuthURL
+	p.TokenURL = config.TokenURL
+	p.JWKSURL = config.JWKSURL
+	return endpoints{p.AuthURL, p.TokenURL, p.JWKSURL}, nil
+}
+
+// issuedBy reports whether iss is issuer of provider, google issuer
+// matches with or without scheme
+func (p *Provider) issuedBy(iss string) bool {
+	return iss == p.Issuer || (isGoogle(p.Issuer) && isGoogle(iss))
+}
+
+func isGoogle(iss string) bool {
+	return iss == GoogleIssuer || iss == googleIssuerHost
+}
+
+// key is public key of kid, keys are fetched again for unknown kid as
+// providers rotate them but not sooner than jwksRefetch after a fetch
+// so tokens of made up kids do not flood the provider. Concurrent
+// callers wait for one fetch
+func (p *Provider) key(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	if key, ok := p.keys[kid]; ok {
+		p.mu.Unlock()
+		return key, nil
+	}
+	f := p.fetching
+	if f == nil {
+		if time.Since(p.fetched) < jwksRefetch {
+			p.mu.Unlock()
+			return nil, ErrorTokenInvalid
+		}
+		f = &keysFetch{done: make(chan struct{})}
+		p.fetching = f
+		jwksURL := p.JWKSURL
+		p.mu.Unlock()
+		keys, err := p.fetchKeys(jwksURL)
+		p.mu.Lock()
+		if err == nil {
+			p.keys = keys
+			p.fetched = time.Now()
+		}
+		f.err = err
+		p.fetching = nil
+		close(f.done)
+	}
+	p.mu.Unlock()
+	<-f.done
+	if f.err != nil {
+		return nil, f.err
+	}
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if !ok {
+		return nil, ErrorTokenInvalid
+	}
+	return key, nil
+}
+
+// keysFetch is a running fetch of keys, err is set when done is closed
+type keysFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func (p *Provider) fetchKeys(jwksURL string) (map[string]crypto.PublicKey, error) {
+	set := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+	if err := p.getJSON(jwksURL, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, err1 := tokenEncoding.DecodeString(k.N)
+			e, err2 := tokenEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err1 := tokenEncoding.DecodeString(k.X)
+			y, err2 := tokenEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (p *Provider) getJSON(url string, v interface{}) error {
+	res, err := p.client().Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %s responded %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (p *Provider) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func challengeOf(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return tokenEncoding.EncodeToString(sum[:])
+}
+
+// nonceOf binds ID token to the login which knows verifier
+func nonceOf(verifier string) string {
+	sum := sha256.Sum256([]byte("nonce:" + verifier))
+	return tokenEncoding.EncodeToString(sum[:])
+}
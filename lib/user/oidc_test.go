@@ -0,0 +1,311 @@
+package user
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeOIDC is a provider which authorizes any user set in claims
+type fakeOIDC struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	claims    map[string]interface{}
+	challenge string
+	nonce     string
+	fetches   int32
+	// failing makes key fetches fail, gate holds them while locked
+	failing int32
+	gate    sync.Mutex
+}
+
+func newFakeOIDC(t *testing.T) *fakeOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeOIDC{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/auth",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.fetches, 1)
+		f.gate.Lock()
+		f.gate.Unlock()
+		if atomic.LoadInt32(&f.failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA", "kid": "1", "alg": "RS256",
+				"n": tokenEncoding.EncodeToString(key.N.Bytes()),
+				"e": tokenEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "code" ||
+			challengeOf(r.Form.Get("code_verifier")) != f.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		claims := map[string]interface{}{
+			"iss": f.URL, "aud": "client", "nonce": f.nonce,
+			"exp": time.Now().Add(time.Hour).Unix(), "iat": time.Now().Unix(),
+		}
+		for k, v := range f.claims {
+			claims[k] = v
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": f.sign(t, claims)})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeOIDC) sign(t *testing.T, claims map[string]interface{}) string {
+	return f.signKid(t, "1", claims)
+}
+
+func (f *fakeOIDC) signKid(t *testing.T, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	unsigned := tokenEncoding.EncodeToString(header) + "." + tokenEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return unsigned + "." + tokenEncoding.EncodeToString(signature)
+}
+
+// authorize follows auth url like a browser and returns state
+func (f *fakeOIDC) authorize(t *testing.T, p *Provider) string {
+	authURL, err := p.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(authURL)
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "client" {
+		t.Fatal("auth url", authURL)
+	}
+	f.challenge = q.Get("code_challenge")
+	f.nonce = q.Get("nonce")
+	return q.Get("state")
+}
+
+func TestOIDC(t *testing.T) {
+	testPackageinit()
+	f := newFakeOIDC(t)
+	p := &Provider{Name: "fake", Issuer: f.URL, ClientID: "client", RedirectURL: "http://shop/callback"}
+
+	f.claims = map[string]interface{}{
+		"sub": "1", "email": "Oidc@test.com", "email_verified": true, "name": "Oidc",
+	}
+	state := f.authorize(t, p)
+	result, err := p.Callback(state, "code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := result.User
+	if created.Email != "oidc@test.com" || !created.EmailVerified || created.Fullname != "Oidc" {
+		t.Error("created user", created)
+	}
+	if _, err := p.Callback(state, "code"); err != ErrorTokenInvalid {
+		t.Error("state used twice", err)
+	}
+
+	// same identity logs in to the same user
+	again, err := p.Callback(f.authorize(t, p), "code")
+	if err != nil || again.User.ID != created.ID {
+		t.Error("login of linked identity", err)
+	}
+
+	// verified email links to existing unverified account
+	local, _ := Form{Email: "local@test.com", Password: "secret"}.Register()
+	f.claims = map[string]interface{}{"sub": "2", "email": "local@test.com", "email_verified": true}
+	linked, err := p.Callback(f.authorize(t, p), "code")
+	if err != nil || linked.User.ID != local.ID || linked.User.Password != "" {
+		t.Error("link by email", err)
+	}
+
+	f.claims = map[string]interface{}{"sub": "3", "email": "unverified@test.com"}
+	if _, err := p.Callback(f.authorize(t, p), "code"); err != ErrorProviderEmail {
+		t.Error("unverified email accepted", err)
+	}
+
+	f.claims = map[string]interface{}{"sub": "4", "email": "nonce@test.com",
+		"email_verified": true, "nonce": "other"}
+	if _, err := p.Callback(f.authorize(t, p), "code"); err != ErrorTokenInvalid {
+		t.Error("token of other login accepted", err)
+	}
+
+	token := f.sign(t, map[string]interface{}{"iss": f.URL, "sub": "5", "aud": "other",
+		"exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := p.VerifyIDToken(token); err != ErrorTokenInvalid {
+		t.Error("token of other client verified", err)
+	}
+	token = f.sign(t, map[string]interface{}{"iss": f.URL, "sub": "5", "aud": "client",
+		"exp": time.Now().Add(-time.Hour).Unix()})
+	if _, err := p.VerifyIDToken(token); err != ErrorTokenExpired {
+		t.Error("expired token verified", err)
+	}
+	if _, err := p.VerifyIDToken(token[:len(token)-4] + "AAAA"); err != ErrorTokenInvalid {
+		t.Error("tampered token verified", err)
+	}
+}
+
+func TestOIDCGoogle(t *testing.T) {
+	testPackageinit()
+	f := newFakeOIDC(t)
+	p := Google("client", "secret", "http://shop/callback")
+	p.JWKSURL = f.URL + "/jwks"
+	for i, iss := range []string{GoogleIssuer, "accounts.google.com"} {
+		token := f.sign(t, map[string]interface{}{"iss": iss, "sub": "google", "aud": "client",
+			"exp": time.Now().Add(time.Hour).Unix()})
+		claims, err := p.VerifyIDToken(token)
+		if err != nil {
+			t.Fatal(iss, err)
+		}
+		if i > 0 {
+			continue
+		}
+		claims.Email, claims.EmailVerified = "google@test.com", true
+		result, err := p.login(claims)
+		if err != nil || result.User.GoogleID != "google" {
+			t.Error("google id is not set", err)
+		}
+	}
+	token := f.sign(t, map[string]interface{}{"iss": "https://other.com", "sub": "google",
+		"aud": "client", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := p.VerifyIDToken(token); err != ErrorTokenInvalid {
+		t.Error("token of other issuer verified", err)
+	}
+}
+
+func TestJWKSRefetch(t *testing.T) {
+	testPackageinit()
+	f := newFakeOIDC(t)
+	p := &Provider{Name: "fake", Issuer: f.URL, ClientID: "client", JWKSURL: f.URL + "/jwks"}
+	claims := map[string]interface{}{"iss": f.URL, "sub": "1", "aud": "client",
+		"exp": time.Now().Add(time.Hour).Unix()}
+	if _, err := p.VerifyIDToken(f.sign(t, claims)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := p.VerifyIDToken(f.signKid(t, "unknown", claims)); err != ErrorTokenInvalid {
+			t.Error("unknown kid verified", err)
+		}
+	}
+	if fetches := atomic.LoadInt32(&f.fetches); fetches != 1 {
+		t.Error("keys fetched", fetches, "times")
+	}
+	// a minute after last fetch unknown kid fetches keys again
+	p.fetched = time.Now().Add(-jwksRefetch)
+	p.VerifyIDToken(f.signKid(t, "unknown", claims))
+	if fetches := atomic.LoadInt32(&f.fetches); fetches != 2 {
+		t.Error("keys are not fetched again", fetches)
+	}
+}
+
+func TestJWKSFetchFailure(t *testing.T) {
+	testPackageinit()
+	f := newFakeOIDC(t)
+	p := &Provider{Name: "fake", Issuer: f.URL, ClientID: "client", JWKSURL: f.URL + "/jwks"}
+	token := f.sign(t, map[string]interface{}{"iss": f.URL, "sub": "1", "aud": "client",
+		"exp": time.Now().Add(time.Hour).Unix()})
+	atomic.StoreInt32(&f.failing, 1)
+	if _, err := p.VerifyIDToken(token); err == nil {
+		t.Fatal("verified without keys")
+	}
+	// failed fetch does not hold next logins back
+	atomic.StoreInt32(&f.failing, 0)
+	if _, err := p.VerifyIDToken(token); err != nil {
+		t.Error("keys are not fetched after failure", err)
+	}
+
+	// concurrent logins wait for one fetch
+	p = &Provider{Name: "fake", Issuer: f.URL, ClientID: "client", JWKSURL: f.URL + "/jwks"}
+	atomic.StoreInt32(&f.fetches, 0)
+	f.gate.Lock()
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := p.VerifyIDToken(token)
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	f.gate.Unlock()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error("concurrent login", err)
+		}
+	}
+	if fetches := atomic.LoadInt32(&f.fetches); fetches != 1 {
+		t.Error("keys fetched", fetches, "times")
+	}
+}
+
+func TestOIDCConcurrentDiscover(t *testing.T) {
+	testPackageinit()
+	f := newFakeOIDC(t)
+	p := &Provider{Name: "fake", Issuer: f.URL, ClientID: "client", RedirectURL: "http://shop/callback"}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.AuthCodeURL(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestOIDCStatesExpire(t *testing.T) {
+	testPackageinit()
+	f := newFakeOIDC(t)
+	p := &Provider{Name: "fake", Issuer: f.URL, ClientID: "client", RedirectURL: "http://shop/callback"}
+	if err := db.Create(&OneTimeToken{Purpose: purposeOIDC + p.Name, Hash: "abandoned",
+		ExpiresAt: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.AuthCodeURL(); err != nil {
+		t.Fatal(err)
+	}
+	tokens := []OneTimeToken{}
+	if err := db.Where(bson.M{"purpose": purposeOIDC + p.Name}).Find(&tokens); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Hash == "abandoned" {
+		t.Error("expired state is kept", tokens)
+	}
+}
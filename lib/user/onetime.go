@@ -0,0 +1,93 @@
+package user
+
+import (
+	"time"
+
+	"github.com/jeyem/gocommerce/util/random"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OneTimeToken is a single use token sent to user for Purpose like a
+// password reset, only its hash is stored and Value keeps data of
+// the action like a new email address
+type OneTimeToken struct {
+	ID        bson.ObjectId `bson:"_id,omitempty"`
+	User      bson.ObjectId `bson:"user,omitempty"`
+	Purpose   string        `bson:"purpose"`
+	Hash      string        `bson:"hash"`
+	Value     string        `bson:"value,omitempty"`
+	CreatedAt time.Time     `bson:"created_at"`
+	ExpiresAt time.Time     `bson:"expires_at"`
+}
+
+func (OneTimeToken) Meta() []mgo.Index {
+	return []mgo.Index{
+		{Key: []string{"hash"}, Unique: true},
+		{Key: []string{"user", "purpose"}},
+		// mongo removes expired tokens which are never used
+		{Key: []string{"expires_at"}, ExpireAfter: time.Second},
+	}
+}
+
+// purgeTokens removes expired tokens of purpose, for storages which do
+// not expire documents by themselves
+func purgeTokens(purpose string) error {
+	_, err := db.Remove(&OneTimeToken{}, bson.M{
+		"purpose": purpose, "expires_at": bson.M{"$lt": time.Now()},
+	})
+	return err
+}
+
+// issueToken replaces pending tokens of purpose of u with a new one
+func issueToken(u *User, purpose, value string, ttl time.Duration) (string, error) {
+	if _, err := db.Remove(&OneTimeToken{}, bson.M{
+		"user": u.ID, "purpose": purpose,
+	}); err != nil {
+		return "", err
+	}
+	token := random.URLSafe(refreshLength)
+	now := time.Now()
+	if err := db.Create(&OneTimeToken{
+		User:      u.ID,
+		Purpose:   purpose,
+		Hash:      hashToken(token),
+		Value:     value,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// peekToken loads token of purpose without using it
+func peekToken(purpose, token string) (*OneTimeToken, error) {
+	t := new(OneTimeToken)
+	if err := db.Where(bson.M{
+		"hash": hashToken(token), "purpose": purpose,
+	}).Find(t); err != nil {
+		return nil, ErrorTokenInvalid
+	}
+	if time.Now().After(t.ExpiresAt) {
+		return nil, ErrorTokenExpired
+	}
+	return t, nil
+}
+
+// useToken checks and removes token so only one caller can use it
+func useToken(purpose, token string) (*OneTimeToken, error) {
+	t, err := peekToken(purpose, token)
+	if err != nil {
+		return nil, err
+	}
+	removed, err := db.Remove(t, bson.M{"_id": t.ID})
+	if err != nil {
+		return nil, err
+	}
+	if removed != 1 {
+		return nil, ErrorTokenInvalid
+	}
+	return t, nil
+}
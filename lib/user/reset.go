@@ -0,0 +1,70 @@
+package user
+
+import (
+	"time"
+
+	"github.com/asaskevich/govalidator"
+)
+
+const (
+	purposeReset = "password_reset"
+	resetTTL     = time.Hour
+)
+
+type ResetForm struct {
+	Token    string `form:"token" json:"token" valid:"required"`
+	Password string `form:"password" json:"password" valid:"required"`
+}
+
+// RequestPasswordReset sends a reset token to user of email or call,
+// unknown identifiers are not reported so accounts can not be probed.
+// Requests of an identifier are limited like failed logins
+func RequestPasswordReset(identifier string) error {
+	// variants of an address share its limit
+	identifier = fixIdentifier(identifier)
+	if err := limiter.throttle("reset:" + identifier); err != nil {
+		return err
+	}
+	u := new(User)
+	if err := u.loadByIdentifier(identifier); err != nil {
+		return nil
+	}
+	token, err := issueToken(u, purposeReset, "", resetTTL)
+	if err != nil {
+		return err
+	}
+	return u.notifyAny(MessagePasswordReset, map[string]interface{}{
+		"Token":   token,
+		"Minutes": int(resetTTL.Minutes()),
+	})
+}
+
+// Reset sets password of token owner, ends all of their sessions and
+// tells them password is changed
+func (f ResetForm) Reset() (*User, error) {
+	if _, err := govalidator.ValidateStruct(f); err != nil {
+		return nil, err
+	}
+	if err := ValidatePassword(f.Password); err != nil {
+		return nil, err
+	}
+	t, err := useToken(purposeReset, f.Token)
+	if err != nil {
+		return nil, err
+	}
+	u := new(User)
+	if err := u.Load(t.User); err != nil {
+		return nil, ErrorTokenInvalid
+	}
+	if u.Password, err = MakePassword(f.Password); err != nil {
+		return nil, err
+	}
+	if err := u.revokeSessions(); err != nil {
+		return nil, err
+	}
+	if err := u.Save(); err != nil {
+		return nil, err
+	}
+	u.notifyAny(MessagePasswordChanged, nil)
+	return u, nil
+}
@@ -0,0 +1,120 @@
+package user
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNotifier keeps sent messages by address
+type fakeNotifier map[string][]Message
+
+func (n fakeNotifier) Send(to string, m Message) error {
+	n[to] = append(n[to], m)
+	return nil
+}
+
+func testNotifier(t *testing.T) fakeNotifier {
+	n := fakeNotifier{}
+	SetNotifier(ChannelEmail, n)
+	SetNotifier(ChannelSMS, n)
+	t.Cleanup(func() {
+		SetNotifier(ChannelEmail, nil)
+		SetNotifier(ChannelSMS, nil)
+	})
+	return n
+}
+
+func TestValidatePassword(t *testing.T) {
+	for password, valid := range map[string]bool{
+		"short1":          false,
+		"onlyletters":     false,
+		"1234567890":      false,
+		"Password123":     false,
+		"correct horse 1": true,
+		"s3cure-enough":   true,
+	} {
+		if (ValidatePassword(password) == nil) != valid {
+			t.Error(password, "expected valid", valid)
+		}
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	testPackageinit()
+	notifier := testNotifier(t)
+	form := Form{Email: "reset@test.com", Password: "old password 1"}
+	u, err := form.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := &Tokens{Secret: []byte("secret")}
+	session, _ := tokens.Issue(u)
+
+	if err := RequestPasswordReset("unknown@test.com"); err != nil {
+		t.Error("unknown identifier is reported", err)
+	}
+	if err := RequestPasswordReset("Reset@test.com"); err != nil {
+		t.Fatal(err)
+	}
+	sent := notifier[u.Email]
+	if len(sent) == 0 || sent[len(sent)-1].Subject != "Reset your password" {
+		t.Fatal("reset message not sent", notifier)
+	}
+	token := strings.Fields(sent[len(sent)-1].Body)[1]
+
+	if _, err := (ResetForm{Token: token, Password: "weak"}).Reset(); err != ErrorWeakPassword {
+		t.Error("weak password accepted", err)
+	}
+	if _, err := (ResetForm{Token: token, Password: "new password 1"}).Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (ResetForm{Token: token, Password: "new password 2"}).Reset(); err != ErrorTokenInvalid {
+		t.Error("token used twice", err)
+	}
+	if _, err := form.Login(); err != ErrorUserPass {
+		t.Error("old password still works", err)
+	}
+	if _, err := (Form{Email: form.Email, Password: "new password 1"}).Login(); err != nil {
+		t.Error("login with new password", err)
+	}
+	if _, err := tokens.Refresh(session.RefreshToken); err != ErrorTokenRevoked {
+		t.Error("session is not revoked", err)
+	}
+	if _, _, err := tokens.VerifyUser(session.AccessToken); err != ErrorTokenRevoked {
+		t.Error("access token is not revoked", err)
+	}
+	u.Load(u.ID)
+	if fresh, _ := tokens.Issue(u); fresh == nil {
+		t.Error("no session after reset")
+	} else if _, _, err := tokens.VerifyUser(fresh.AccessToken); err != nil {
+		t.Error("access token after reset", err)
+	}
+	if sent := notifier[u.Email]; sent[len(sent)-1].Subject != "Your password is changed" {
+		t.Error("password change is not notified", sent)
+	}
+}
+
+func TestPasswordResetThrottle(t *testing.T) {
+	testPackageinit()
+	testNotifier(t)
+	testLimiter(t, &Limiter{Store: NewMemoryAttempts(), FreeAttempts: 2, Backoff: time.Hour})
+	if _, err := (Form{Email: "throttle@test.com", Password: "secret"}).Register(); err != nil {
+		t.Fatal(err)
+	}
+	for _, identifier := range []string{"throttle@test.com", "Throttle@test.com"} {
+		if err := RequestPasswordReset(identifier); err != nil {
+			t.Fatal("request", identifier, err)
+		}
+	}
+	if err := RequestPasswordReset("THROTTLE@test.com"); err != ErrorTooManyAttempts {
+		t.Error("requests are not limited", err)
+	}
+	// unknown identifiers are limited the same
+	for i := 0; i < 2; i++ {
+		RequestPasswordReset("unknown@test.com")
+	}
+	if err := RequestPasswordReset("unknown@test.com"); err != ErrorTooManyAttempts {
+		t.Error("requests of unknown identifier are not limited", err)
+	}
+}
@@ -0,0 +1,195 @@
+package user
+
+import (
+	"time"
+
+	"github.com/jeyem/gocommerce/lib/file"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	RoleCustomer = "customer"
+	RoleSeller   = "seller"
+	RoleSupport  = "support"
+	RoleAdmin    = "admin"
+
+	// AllPermissions grants everything
+	AllPermissions = "*"
+	// anyScope suffix grants permission on resources of other users,
+	// without it permission covers only resources owned by the user
+	anyScope = ":any"
+)
+
+// DefaultRoles are created by SeedRoles when missing
+var DefaultRoles = map[string][]string{
+	RoleCustomer: {
+		"orders:create", "orders:read", "orders:cancel",
+		"files:upload", "files:read", "files:delete",
+		"users:read", "users:update",
+	},
+	RoleSeller: {
+		"products:create", "products:update", "products:delete",
+		"orders:read", "orders:update",
+		"files:upload", "files:read", "files:delete",
+		"users:read", "users:update",
+	},
+	RoleSupport: {
+		"orders:read:any", "orders:update:any", "orders:refund:any",
+		"users:read:any", "files:read:any",
+	},
+	RoleAdmin: {AllPermissions},
+}
+
+// Role grants permissions like orders:refund or files:delete:any to
+// users having Name as User.Role, changes apply on next check
+type Role struct {
+	ID          bson.ObjectId `bson:"_id,omitempty"`
+	Name        string        `bson:"name"`
+	Permissions []string      `bson:"permissions"`
+	UpdatedAt   time.Time     `bson:"updated_at"`
+}
+
+func (Role) Meta() []mgo.Index {
+	return []mgo.Index{
+		{Key: []string{"name"}, Unique: true},
+	}
+}
+
+func (r *Role) Save() error {
+	r.UpdatedAt = time.Now()
+	if r.ID.Valid() {
+		return db.Update(r)
+	}
+	if err := LoadRole(new(Role), r.Name); err == nil {
+		return ErrorDuplicateRole
+	}
+	return db.Create(r)
+}
+
+// Allows reports whether r has permission in any scope, or only
+// for owned resources when own is set
+func (r *Role) Allows(permission string, own bool) bool {
+	for _, p := range r.Permissions {
+		if p == AllPermissions || p == permission+anyScope ||
+			(own && p == permission) {
+			return true
+		}
+	}
+	return false
+}
+
+func LoadRole(r *Role, name string) error {
+	return db.Where(bson.M{"name": name}).Find(r)
+}
+
+func LoadRoles() (roles []Role, err error) {
+	err = db.Where(bson.M{}).Sort("name").Find(&roles)
+	return roles, err
+}
+
+// SeedRoles creates DefaultRoles which are not stored yet
+func SeedRoles() error {
+	for name, perms := range DefaultRoles {
+		if err := LoadRole(new(Role), name); err == nil {
+			continue
+		}
+		r := &Role{Name: name, Permissions: perms}
+		if err := r.Save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Grant adds permissions to role, creating it when missing
+func Grant(name string, perms ...string) error {
+	r := new(Role)
+	if err := LoadRole(r, name); err != nil {
+		r = &Role{Name: name}
+	}
+	for _, p := range perms {
+		if !r.has(p) {
+			r.Permissions = append(r.Permissions, p)
+		}
+	}
+	return r.Save()
+}
+
+// Revoke removes permissions from role
+func Revoke(name string, perms ...string) error {
+	r := new(Role)
+	if err := LoadRole(r, name); err != nil {
+		return err
+	}
+	kept := []string{}
+	for _, p := range r.Permissions {
+		revoked := false
+		for _, perm := range perms {
+			revoked = revoked || p == perm
+		}
+		if !revoked {
+			kept = append(kept, p)
+		}
+	}
+	r.Permissions = kept
+	return r.Save()
+}
+
+// HasPermission reports whether role of u grants permission at least
+// for owned resources, use Can to check it on a resource
+func (u *User) HasPermission(permission string) bool {
+	r := new(Role)
+	if err := LoadRole(r, u.Role); err != nil {
+		return false
+	}
+	return r.Allows(permission, true)
+}
+
+// Can reports whether u may do permission on resource, permissions
+// without :any scope pass only for resources owned by u. A nil
+// resource checks permission like HasPermission
+func Can(u *User, permission string, resource interface{}) bool {
+	if u == nil || !u.ID.Valid() {
+		return false
+	}
+	if resource == nil {
+		return u.HasPermission(permission)
+	}
+	r := new(Role)
+	if err := LoadRole(r, u.Role); err != nil {
+		return false
+	}
+	return r.Allows(permission, ownerOf(resource) == u.ID)
+}
+
+// Owned is implemented by resources which belong to a user
+type Owned interface {
+	OwnerID() bson.ObjectId
+}
+
+func ownerOf(resource interface{}) bson.ObjectId {
+	switch r := resource.(type) {
+	case Owned:
+		return r.OwnerID()
+	case *file.File:
+		return r.Owner
+	case file.File:
+		return r.Owner
+	case *User:
+		return r.ID
+	case User:
+		return r.ID
+	}
+	return ""
+}
+
+func (r *Role) has(permission string) bool {
+	for _, p := range r.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/jeyem/gocommerce/lib/file"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCan(t *testing.T) {
+	testPackageinit()
+	if err := SeedRoles(); err != nil {
+		t.Fatal(err)
+	}
+	customer := &User{Email: "customer@test.com"}
+	if err := customer.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if customer.Role != RoleCustomer {
+		t.Fatal("new user role", customer.Role)
+	}
+	support := &User{ID: bson.NewObjectId(), Role: RoleSupport}
+	admin := &User{ID: bson.NewObjectId(), Role: RoleAdmin}
+	own := &file.File{Owner: customer.ID}
+	other := &file.File{Owner: bson.NewObjectId()}
+
+	tests := []struct {
+		u          *User
+		permission string
+		resource   interface{}
+		can        bool
+	}{
+		{customer, "files:delete", own, true},
+		{customer, "files:delete", other, false},
+		{customer, "files:delete", nil, true},
+		{customer, "orders:refund", nil, false},
+		{customer, "users:update", customer, true},
+		{customer, "users:update", support, false},
+		{support, "files:read", other, true},
+		{support, "files:delete", other, false},
+		{support, "orders:refund", nil, true},
+		{admin, "files:delete", other, true},
+		{nil, "files:read", own, false},
+	}
+	for _, test := range tests {
+		if Can(test.u, test.permission, test.resource) != test.can {
+			t.Error(test.u, test.permission, "expected", test.can)
+		}
+	}
+
+	// roles are editable at runtime
+	if err := Grant(RoleCustomer, "files:delete:any"); err != nil {
+		t.Fatal(err)
+	}
+	if !Can(customer, "files:delete", other) {
+		t.Error("granted permission is not applied")
+	}
+	if err := Revoke(RoleCustomer, "files:delete:any", "files:delete"); err != nil {
+		t.Fatal(err)
+	}
+	if Can(customer, "files:delete", own) {
+		t.Error("revoked permission is still applied")
+	}
+	if err := (&Role{Name: RoleAdmin}).Save(); err != ErrorDuplicateRole {
+		t.Error("duplicate role saved", err)
+	}
+}
@@ -1,16 +1,15 @@
 package user
 
 import (
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/hex"
-	"fmt"
 	"strings"
-
-	"golang.org/x/crypto/pbkdf2"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 128
+
 	method     = "pbkdf2:sha256"
 	saltLength = 8
 	iterations = 50000
@@ -18,18 +17,89 @@ const (
 	saltChars  = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 )
 
-func MakePassword(password string) string {
-	salt := genSalt()
-	hash := hashInternal(salt, password)
-	return fmt.Sprintf("pbkdf2:sha256:%v$%s$%s", iterations, salt, hash)
+var commonPasswords = map[string]bool{
+	"password1": true, "password123": true, "passw0rd": true,
+	"qwerty123": true, "abc12345": true, "abcd1234": true,
+	"1q2w3e4r": true, "1qaz2wsx": true, "iloveyou1": true,
+	"welcome1": true, "admin123": true, "letmein1": true,
+}
+
+// MakePassword hashes password with hasher set by SetHasher
+func MakePassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
 }
 
+// CheckPassword checks password against hash of any known algorithm
 func CheckPassword(password string, hash string) bool {
-	if strings.Count(hash, "$") < 2 {
-		return false
+	for _, h := range hashers {
+		if h.Identify(hash) {
+			return h.Verify(password, hash)
+		}
+	}
+	return false
+}
+
+// NeedsRehash reports whether hash is not made by current hasher and
+// its parameters
+func NeedsRehash(hash string) bool {
+	return !passwordHasher.Identify(hash) || passwordHasher.Outdated(hash)
+}
+
+// ValidatePassword refuses short, common and single class passwords
+func ValidatePassword(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < MinPasswordLength || length > MaxPasswordLength {
+		return ErrorWeakPassword
+	}
+	if commonPasswords[strings.ToLower(password)] {
+		return ErrorWeakPassword
+	}
+	var letter, other bool
+	for _, r := range password {
+		if unicode.IsLetter(r) {
+			letter = true
+		} else {
+			other = true
+		}
+	}
+	if !letter || !other {
+		return ErrorWeakPassword
 	}
-	pwdHashList := strings.Split(hash, "$")
-	return pwdHashList[2] == hashInternal(pwdHashList[1], password)
+	return nil
+}
+
+// CallingCode is country code of calls, numbers with it are written
+// in national format by CallFixer
+var CallingCode = "98"
+
+// CallFixer drops separators of call and converts Persian and Arabic
+// digits, +98 912 000 0000 becomes 09120000000
+func CallFixer(call string) string {
+	call = strings.TrimSpace(call)
+	digits := make([]byte, 0, len(call))
+	for _, r := range call {
+		switch {
+		case r >= '0' && r <= '9':
+			digits = append(digits, byte(r))
+		case r >= '۰' && r <= '۹':
+			digits = append(digits, byte('0'+r-'۰'))
+		case r >= '٠' && r <= '٩':
+			digits = append(digits, byte('0'+r-'٠'))
+		}
+	}
+	number := string(digits)
+	international := strings.HasPrefix(call, "+")
+	if strings.HasPrefix(number, "00") {
+		number = number[2:]
+		international = true
+	}
+	if !international || number == "" {
+		return number
+	}
+	if CallingCode != "" && strings.HasPrefix(number, CallingCode) {
+		return "0" + number[len(CallingCode):]
+	}
+	return "+" + number
 }
 
 func EmailFixer(email string) string {
@@ -46,17 +116,3 @@ func EmailFixer(email string) string {
 	username = strings.Replace(username, ".", "", -1)
 	return username + "@" + domain
 }
-
-func genSalt() string {
-	var bytes = make([]byte, saltLength)
-	rand.Read(bytes)
-	for k, v := range bytes {
-		bytes[k] = saltChars[v%byte(len(saltChars))]
-	}
-	return string(bytes)
-}
-
-func hashInternal(salt string, password string) string {
-	hash := pbkdf2.Key([]byte(password), []byte(salt), iterations, charLength/2, sha256.New)
-	return hex.EncodeToString(hash)
-}
@@ -3,6 +3,26 @@ package user
 import "errors"
 
 var (
-	ErrorDuplicateUser = errors.New("user already exists")
-	ErrorUserPass      = errors.New("user or password not matched")
+	ErrorDuplicateUser   = errors.New("user already exists")
+	ErrorUserPass        = errors.New("user or password not matched")
+	ErrorTokenInvalid    = errors.New("token is not valid")
+	ErrorTokenExpired    = errors.New("token is expired")
+	ErrorTokenRevoked    = errors.New("token is revoked")
+	ErrorTokenConfig     = errors.New("token signing is not configured")
+	ErrorForbidden       = errors.New("not allowed")
+	ErrorDuplicateRole   = errors.New("role already exists")
+	ErrorTooManyAttempts = errors.New("too many attempts, try again later")
+	ErrorLocked          = errors.New("account is locked")
+	ErrorUnlockKey       = errors.New("unlock key is not valid")
+	ErrorNoAddress       = errors.New("user has no address for channel")
+	ErrorNoTemplate      = errors.New("no template for message")
+	ErrorNotVerified     = errors.New("email is not verified")
+	ErrorProviderEmail   = errors.New("provider did not verify email")
+	ErrorTOTPCode        = errors.New("authentication code is not valid")
+	ErrorTOTPEnabled     = errors.New("two factor authentication is already enabled")
+	ErrorEncryptionKey   = errors.New("encryption key must be 32 bytes")
+	ErrorWeakPassword    = errors.New("password must have 8 characters with letters and numbers or symbols")
+	ErrorLegacyHash      = errors.New("hasher only checks imported passwords")
+	ErrorUnknownHash     = errors.New("password hash format is not known")
+	ErrorImportRecord    = errors.New("record has no valid email or call")
 )
@@ -0,0 +1,354 @@
+package user
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jeyem/gocommerce/util/random"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+
+	defaultAccessTTL  = 15 * time.Minute
+	defaultRefreshTTL = 30 * 24 * time.Hour
+	refreshLength     = 32
+)
+
+var tokenEncoding = base64.RawURLEncoding
+
+// Tokens issues signed access tokens and rotating refresh tokens,
+// Secret is used by HS256 and PrivateKey, PublicKey by EdDSA. Services
+// which only verify access tokens may leave PrivateKey empty
+type Tokens struct {
+	Method     string
+	Secret     []byte
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+	Issuer     string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// Claims of access token, Subject is hex of user id
+type Claims struct {
+	ID        string `json:"jti"`
+	Subject   string `json:"sub"`
+	Role      string `json:"role,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// Version is TokenVersion of user when token is issued
+	Version int `json:"ver,omitempty"`
+}
+
+func (c Claims) UserID() bson.ObjectId {
+	if !bson.IsObjectIdHex(c.Subject) {
+		return ""
+	}
+	return bson.ObjectIdHex(c.Subject)
+}
+
+// Session is what a login returns to clients
+type Session struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// RefreshToken is stored by hash, every refresh replaces it with a new
+// one of the same Family, using a replaced token again revokes family
+type RefreshToken struct {
+	ID         bson.ObjectId `bson:"_id,omitempty"`
+	User       bson.ObjectId `bson:"user"`
+	Hash       string        `bson:"hash"`
+	Family     bson.ObjectId `bson:"family"`
+	ReplacedBy bson.ObjectId `bson:"replaced_by,omitempty"`
+	CreatedAt  time.Time     `bson:"created_at"`
+	ExpiresAt  time.Time     `bson:"expires_at"`
+	RevokedAt  time.Time     `bson:"revoked_at,omitempty"`
+}
+
+func (RefreshToken) Meta() []mgo.Index {
+	return []mgo.Index{
+		{Key: []string{"hash"}, Unique: true},
+		{Key: []string{"user"}},
+		{Key: []string{"family"}},
+	}
+}
+
+func (rt *RefreshToken) Revoked() bool {
+	return !rt.RevokedAt.IsZero()
+}
+
+// Issue starts a new session of u
+func (t *Tokens) Issue(u *User) (*Session, error) {
+	session, _, err := t.session(u, bson.NewObjectId())
+	return session, err
+}
+
+// Refresh rotates refresh token and issues a new session, refreshing
+// with an already rotated token revokes all tokens of its family
+func (t *Tokens) Refresh(refresh string) (*Session, error) {
+	rt := new(RefreshToken)
+	if err := db.Where(bson.M{"hash": hashToken(refresh)}).Find(rt); err != nil {
+		return nil, ErrorTokenInvalid
+	}
+	if rt.Revoked() {
+		if rt.ReplacedBy.Valid() {
+			revokeRefresh(bson.M{"family": rt.Family})
+		}
+		return nil, ErrorTokenRevoked
+	}
+	if time.Now().After(rt.ExpiresAt) {
+		return nil, ErrorTokenExpired
+	}
+	u := new(User)
+	if err := u.Load(rt.User); err != nil {
+		return nil, ErrorTokenInvalid
+	}
+	session, next, err := t.session(u, rt.Family)
+	if err != nil {
+		return nil, err
+	}
+	rt.RevokedAt = time.Now()
+	rt.ReplacedBy = next.ID
+	if err := db.Update(rt); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Revoke ends session of refresh token
+func (t *Tokens) Revoke(refresh string) error {
+	rt := new(RefreshToken)
+	if err := db.Where(bson.M{"hash": hashToken(refresh)}).Find(rt); err != nil {
+		return ErrorTokenInvalid
+	}
+	return revokeRefresh(bson.M{"family": rt.Family})
+}
+
+// RevokeUser ends all sessions of user, access tokens are refused by
+// VerifyUser while Verify alone accepts them until they expire
+func RevokeUser(id bson.ObjectId) error {
+	u := new(User)
+	if err := u.Load(id); err != nil {
+		return err
+	}
+	if err := u.revokeSessions(); err != nil {
+		return err
+	}
+	return u.Update()
+}
+
+// revokeSessions revokes refresh tokens of u and bumps its TokenVersion,
+// caller saves u
+func (u *User) revokeSessions() error {
+	u.TokenVersion++
+	return revokeRefresh(bson.M{"user": u.ID})
+}
+
+// Verify checks signature, expiry and issuer of access token
+func (t *Tokens) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrorTokenInvalid
+	}
+	header := struct {
+		Alg string `json:"alg"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrorTokenInvalid
+	}
+	// alg of header must be the configured one, never "none"
+	if header.Alg != t.method() {
+		return nil, ErrorTokenInvalid
+	}
+	signature, err := tokenEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrorTokenInvalid
+	}
+	if !t.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrorTokenInvalid
+	}
+	claims := new(Claims)
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, ErrorTokenInvalid
+	}
+	if t.Issuer != "" && claims.Issuer != t.Issuer {
+		return nil, ErrorTokenInvalid
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrorTokenExpired
+	}
+	return claims, nil
+}
+
+// VerifyUser verifies token and loads its user, tokens issued before
+// RevokeUser or a password reset are revoked
+func (t *Tokens) VerifyUser(token string) (*User, *Claims, error) {
+	claims, err := t.Verify(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	u := new(User)
+	if err := u.Load(claims.UserID()); err != nil {
+		return nil, nil, ErrorTokenInvalid
+	}
+	if claims.Version != u.TokenVersion {
+		return nil, nil, ErrorTokenRevoked
+	}
+	return u, claims, nil
+}
+
+func (t *Tokens) session(u *User, family bson.ObjectId) (*Session, *RefreshToken, error) {
+	if !u.ID.Valid() {
+		return nil, nil, ErrorTokenInvalid
+	}
+	now := time.Now()
+	access, err := t.sign(Claims{
+		ID:        bson.NewObjectId().Hex(),
+		Subject:   u.ID.Hex(),
+		Role:      u.Role,
+		Issuer:    t.Issuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(t.accessTTL()).Unix(),
+		Version:   u.TokenVersion,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh := random.URLSafe(refreshLength)
+	rt := &RefreshToken{
+		ID:        bson.NewObjectId(),
+		User:      u.ID,
+		Hash:      hashToken(refresh),
+		Family:    family,
+		CreatedAt: now,
+		ExpiresAt: now.Add(t.refreshTTL()),
+	}
+	if err := db.Create(rt); err != nil {
+		return nil, nil, err
+	}
+	return &Session{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(t.accessTTL().Seconds()),
+	}, rt, nil
+}
+
+func (t *Tokens) sign(claims Claims) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": t.method(), "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := tokenEncoding.EncodeToString(header) + "." + tokenEncoding.EncodeToString(payload)
+	var signature []byte
+	switch t.method() {
+	case HS256:
+		if len(t.Secret) == 0 {
+			return "", ErrorTokenConfig
+		}
+		mac := hmac.New(sha256.New, t.Secret)
+		mac.Write([]byte(unsigned))
+		signature = mac.Sum(nil)
+	case EdDSA:
+		if len(t.PrivateKey) != ed25519.PrivateKeySize {
+			return "", ErrorTokenConfig
+		}
+		signature = ed25519.Sign(t.PrivateKey, []byte(unsigned))
+	default:
+		return "", ErrorTokenConfig
+	}
+	return unsigned + "." + tokenEncoding.EncodeToString(signature), nil
+}
+
+func (t *Tokens) verify(unsigned, signature []byte) bool {
+	switch t.method() {
+	case HS256:
+		if len(t.Secret) == 0 {
+			return false
+		}
+		mac := hmac.New(sha256.New, t.Secret)
+		mac.Write(unsigned)
+		return hmac.Equal(signature, mac.Sum(nil))
+	case EdDSA:
+		public := t.PublicKey
+		if len(public) == 0 && len(t.PrivateKey) == ed25519.PrivateKeySize {
+			public = t.PrivateKey.Public().(ed25519.PublicKey)
+		}
+		if len(public) != ed25519.PublicKeySize {
+			return false
+		}
+		return ed25519.Verify(public, unsigned, signature)
+	}
+	return false
+}
+
+func (t *Tokens) method() string {
+	if t.Method == "" {
+		return HS256
+	}
+	return t.Method
+}
+
+func (t *Tokens) accessTTL() time.Duration {
+	if t.AccessTTL > 0 {
+		return t.AccessTTL
+	}
+	return defaultAccessTTL
+}
+
+func (t *Tokens) refreshTTL() time.Duration {
+	if t.RefreshTTL > 0 {
+		return t.RefreshTTL
+	}
+	return defaultRefreshTTL
+}
+
+func revokeRefresh(query bson.M) error {
+	tokens := []RefreshToken{}
+	if err := db.Where(query).Find(&tokens); err != nil {
+		return err
+	}
+	for _, rt := range tokens {
+		if rt.Revoked() {
+			continue
+		}
+		rt.RevokedAt = time.Now()
+		if err := db.Update(&rt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashToken keeps stored refresh tokens useless if database leaks
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := tokenEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
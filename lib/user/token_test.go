@@ -0,0 +1,99 @@
+package user
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testUser(t *testing.T) *User {
+	u := &User{Email: "token@test.com", Role: "admin"}
+	if err := u.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestTokens(t *testing.T) {
+	testPackageinit()
+	u := testUser(t)
+	public, private, _ := ed25519.GenerateKey(nil)
+	services := []*Tokens{
+		{Secret: []byte("secret"), Issuer: "shop"},
+		{Method: EdDSA, PrivateKey: private, Issuer: "shop"},
+	}
+	for _, tokens := range services {
+		session, err := tokens.Issue(u)
+		if err != nil {
+			t.Fatal(tokens.method(), err)
+		}
+		claims, err := tokens.Verify(session.AccessToken)
+		if err != nil {
+			t.Fatal(tokens.method(), err)
+		}
+		if claims.UserID() != u.ID || claims.Role != "admin" {
+			t.Error(tokens.method(), "claims", claims)
+		}
+		parts := strings.Split(session.AccessToken, ".")
+		tampered := parts[0] + "." + parts[1] + "x." + parts[2]
+		if _, err := tokens.Verify(tampered); err != ErrorTokenInvalid {
+			t.Error(tokens.method(), "tampered token verified", err)
+		}
+		none := tokenEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+		if _, err := tokens.Verify(none); err != ErrorTokenInvalid {
+			t.Error(tokens.method(), "unsigned token verified", err)
+		}
+		expired, _ := tokens.sign(Claims{Subject: u.ID.Hex(), Issuer: "shop",
+			ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+		if _, err := tokens.Verify(expired); err != ErrorTokenExpired {
+			t.Error(tokens.method(), "expired token verified", err)
+		}
+	}
+	verifier := &Tokens{Method: EdDSA, PublicKey: public, Issuer: "other"}
+	session, _ := services[1].Issue(u)
+	if _, err := verifier.Verify(session.AccessToken); err != ErrorTokenInvalid {
+		t.Error("token of other issuer verified", err)
+	}
+	if _, err := services[0].Verify(session.AccessToken); err != ErrorTokenInvalid {
+		t.Error("token verified with other method", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	testPackageinit()
+	u := testUser(t)
+	tokens := &Tokens{Secret: []byte("secret")}
+	first, err := tokens.Issue(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := tokens.Refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Fatal("refresh token is not rotated")
+	}
+	// reusing a rotated token revokes the whole family
+	if _, err := tokens.Refresh(first.RefreshToken); err != ErrorTokenRevoked {
+		t.Error("rotated token refreshed", err)
+	}
+	if _, err := tokens.Refresh(second.RefreshToken); err != ErrorTokenRevoked {
+		t.Error("family is not revoked on reuse", err)
+	}
+
+	other, _ := tokens.Issue(u)
+	if err := RevokeUser(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Refresh(other.RefreshToken); err != ErrorTokenRevoked {
+		t.Error("revoked user session refreshed", err)
+	}
+	if _, _, err := tokens.VerifyUser(other.AccessToken); err != ErrorTokenRevoked {
+		t.Error("revoked user access token verified", err)
+	}
+	if _, err := tokens.Refresh("unknown"); err != ErrorTokenInvalid {
+		t.Error("unknown token refreshed", err)
+	}
+}
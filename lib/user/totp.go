@@ -0,0 +1,292 @@
+package user
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/jeyem/gocommerce/util/random"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// steps before and after current one accepted for clock drift
+	totpWindow = 1
+
+	recoveryCodes      = 10
+	recoveryCodeLength = 10
+
+	purposeSecondFactor = "second_factor"
+	secondFactorTTL     = 5 * time.Minute
+	// secondFactorPrefix and user id are identifier of wrong codes
+	secondFactorPrefix = "2fa:"
+)
+
+var (
+	// encryptionKey encrypts TOTP secrets, see SetEncryptionKey
+	encryptionKey []byte
+
+	base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// LoginResult of a login, users with TOTP get a Challenge instead of
+// User which SecondFactorForm exchanges for the user
+type LoginResult struct {
+	User      *User
+	Challenge string
+}
+
+// Complete reports whether login needs no second factor
+func (r *LoginResult) Complete() bool {
+	return r.User != nil
+}
+
+type SecondFactorForm struct {
+	Challenge string `form:"challenge" json:"challenge" valid:"required"`
+	// Code is a TOTP code or one of recovery codes
+	Code string `form:"code" json:"code" valid:"required"`
+	IP   string `form:"-" json:"-"`
+}
+
+// SetEncryptionKey sets 32 bytes AES key of stored TOTP secrets
+func SetEncryptionKey(key []byte) error {
+	if len(key) != 32 {
+		return ErrorEncryptionKey
+	}
+	encryptionKey = key
+	return nil
+}
+
+// EnrollTOTP starts TOTP enrollment and returns otpauth provisioning
+// uri to show as QR code, it is enabled by ConfirmTOTP
+func (u *User) EnrollTOTP(issuer string) (string, error) {
+	if u.TOTPEnabled {
+		return "", ErrorTOTPEnabled
+	}
+	secret := random.Bytes(20)
+	encrypted, err := encrypt(secret)
+	if err != nil {
+		return "", err
+	}
+	u.TOTPSecret = encrypted
+	if err := u.Update(); err != nil {
+		return "", err
+	}
+	account := u.OrginEmail
+	if account == "" {
+		account = u.Call
+	}
+	q := url.Values{
+		"secret":    {base32NoPadding.EncodeToString(secret)},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + q.Encode(), nil
+}
+
+// ConfirmTOTP enables TOTP with a code of the enrolled secret and
+// returns recovery codes, they are shown once
+func (u *User) ConfirmTOTP(code string) ([]string, error) {
+	if u.TOTPEnabled || u.TOTPSecret == "" {
+		return nil, ErrorTOTPCode
+	}
+	if !u.checkTOTP(code) {
+		return nil, ErrorTOTPCode
+	}
+	u.TOTPEnabled = true
+	codes := u.newRecoveryCodes()
+	return codes, u.Update()
+}
+
+// DisableTOTP turns TOTP off with a code or recovery code
+func (u *User) DisableTOTP(code string) error {
+	if !u.TOTPEnabled {
+		return nil
+	}
+	if !u.checkTOTP(code) && !u.useRecoveryCode(code) {
+		return ErrorTOTPCode
+	}
+	u.TOTPEnabled = false
+	u.TOTPSecret = ""
+	u.TOTPLastStep = 0
+	u.RecoveryCodes = nil
+	return u.Update()
+}
+
+// RegenerateRecoveryCodes replaces recovery codes, a TOTP code is
+// required so a stolen session can not take them
+func (u *User) RegenerateRecoveryCodes(code string) ([]string, error) {
+	if !u.TOTPEnabled || !u.checkTOTP(code) {
+		return nil, ErrorTOTPCode
+	}
+	codes := u.newRecoveryCodes()
+	return codes, u.Update()
+}
+
+// login completes a login which passed its first factor, users with
+// TOTP get a challenge and LastLogin and failures wait for the code
+func (u *User) login() (*LoginResult, error) {
+	if u.TOTPEnabled {
+		// keeps upgraded password hash and verified email
+		if err := u.Update(); err != nil {
+			return nil, err
+		}
+		return u.secondFactor()
+	}
+	u.resetAttempts()
+	u.LastLogin = time.Now()
+	if err := u.Update(); err != nil {
+		return nil, err
+	}
+	return &LoginResult{User: u}, nil
+}
+
+// secondFactor gives challenge of a login which passed first factor
+func (u *User) secondFactor() (*LoginResult, error) {
+	challenge, err := issueToken(u, purposeSecondFactor, "", secondFactorTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{Challenge: challenge}, nil
+}
+
+// Login checks code for challenge of a login, wrong codes are limited
+// and lock the account like passwords, challenge is used up on success
+func (f SecondFactorForm) Login() (*User, error) {
+	if _, err := govalidator.ValidateStruct(f); err != nil {
+		return nil, err
+	}
+	t, err := peekToken(purposeSecondFactor, f.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	u := new(User)
+	if err := u.Load(t.User); err != nil {
+		return nil, ErrorTokenInvalid
+	}
+	if err := limiter.guard(u.secondFactorKey(), f.IP, func() error {
+		if !u.checkTOTP(f.Code) && !u.useRecoveryCode(f.Code) {
+			return ErrorTOTPCode
+		}
+		if u.Locked() {
+			return ErrorLocked
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := useToken(purposeSecondFactor, f.Challenge); err != nil {
+		return nil, err
+	}
+	u.resetAttempts()
+	u.LastLogin = time.Now()
+	return u, u.Update()
+}
+
+func (u *User) secondFactorKey() string {
+	if !u.ID.Valid() {
+		return ""
+	}
+	return secondFactorPrefix + u.ID.Hex()
+}
+
+// checkTOTP verifies code in window, a step is accepted once
+func (u *User) checkTOTP(code string) bool {
+	secret, err := decrypt(u.TOTPSecret)
+	if err != nil || len(code) != totpDigits {
+		return false
+	}
+	step := time.Now().Unix() / totpPeriod
+	for i := -totpWindow; i <= totpWindow; i++ {
+		s := step + int64(i)
+		if s <= u.TOTPLastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totp(secret, s)), []byte(code)) == 1 {
+			u.TOTPLastStep = s
+			return db.Update(u) == nil
+		}
+	}
+	return false
+}
+
+func (u *User) useRecoveryCode(code string) bool {
+	hash := hashToken(strings.ToUpper(strings.Replace(code, "-", "", -1)))
+	for i, c := range u.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(c), []byte(hash)) == 1 {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+			return db.Update(u) == nil
+		}
+	}
+	return false
+}
+
+func (u *User) newRecoveryCodes() []string {
+	codes := make([]string, recoveryCodes)
+	u.RecoveryCodes = make([]string, recoveryCodes)
+	for i := range codes {
+		code := random.String(recoveryCodeLength, random.Unambiguous)
+		u.RecoveryCodes[i] = hashToken(code)
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes
+}
+
+// totp is RFC 6238 code of secret at step
+func totp(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func encrypt(plain []byte) (string, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return "", err
+	}
+	nonce := random.Bytes(gcm.NonceSize())
+	sealed := gcm.Seal(nonce, nonce, plain, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decrypt(encrypted string) ([]byte, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return nil, ErrorEncryptionKey
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func newGCM() (cipher.AEAD, error) {
+	if len(encryptionKey) != 32 {
+		return nil, ErrorEncryptionKey
+	}
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,190 @@
+package user
+
+import (
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPVectors(t *testing.T) {
+	// RFC 6238 appendix B, sha1 with 8 digits truncated to 6
+	secret := []byte("12345678901234567890")
+	for step, code := range map[int64]string{
+		59 / totpPeriod:         "287082",
+		1111111109 / totpPeriod: "081804",
+		1234567890 / totpPeriod: "005924",
+	} {
+		if got := totp(secret, step); got != code {
+			t.Errorf("step %d got %s want %s", step, got, code)
+		}
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	testPackageinit()
+	testEncryptionKey(t)
+	form := Form{Email: "totp@test.com", Password: "secret"}
+	u, err := form.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := u.EnrollTOTP("Shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provisioning, _ := url.Parse(uri)
+	if provisioning.Scheme != "otpauth" || provisioning.Host != "totp" {
+		t.Fatal("provisioning uri", uri)
+	}
+	secret, err := base32NoPadding.DecodeString(provisioning.Query().Get("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(u.TOTPSecret, provisioning.Query().Get("secret")) {
+		t.Error("secret is stored in plain")
+	}
+	step := time.Now().Unix() / totpPeriod
+	codes, err := u.ConfirmTOTP(totp(secret, step-1))
+	if err != nil || len(codes) != recoveryCodes {
+		t.Fatal("confirm", err)
+	}
+
+	result, err := form.Login()
+	if err != nil || result.Complete() || result.Challenge == "" {
+		t.Fatal("login without second factor", err)
+	}
+	// used step can not be replayed
+	if _, err := (SecondFactorForm{Challenge: result.Challenge, Code: totp(secret, step-1)}).Login(); err != ErrorTOTPCode {
+		t.Error("replayed code accepted", err)
+	}
+	logged, err := SecondFactorForm{Challenge: result.Challenge, Code: totp(secret, step)}.Login()
+	if err != nil || logged.ID != u.ID {
+		t.Fatal("second factor", err)
+	}
+	if _, err := (SecondFactorForm{Challenge: result.Challenge, Code: totp(secret, step+1)}).Login(); err != ErrorTokenInvalid {
+		t.Error("challenge used twice", err)
+	}
+
+	result, _ = form.Login()
+	if _, err := (SecondFactorForm{Challenge: result.Challenge, Code: codes[0]}).Login(); err != nil {
+		t.Error("recovery code", err)
+	}
+	result, _ = form.Login()
+	if _, err := (SecondFactorForm{Challenge: result.Challenge, Code: codes[0]}).Login(); err != ErrorTOTPCode {
+		t.Error("recovery code used twice", err)
+	}
+
+	if err := u.Load(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.DisableTOTP(codes[1]); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := form.Login(); err != nil || !result.Complete() {
+		t.Error("login after disable", err)
+	}
+}
+
+func testEncryptionKey(t *testing.T) {
+	key, _ := hex.DecodeString(strings.Repeat("ab", 32))
+	if err := SetEncryptionKey(key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// enableTOTP enrolls u and returns its TOTP secret
+func enableTOTP(t *testing.T, u *User) []byte {
+	uri, err := u.EnrollTOTP("Shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provisioning, _ := url.Parse(uri)
+	secret, err := base32NoPadding.DecodeString(provisioning.Query().Get("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.ConfirmTOTP(totp(secret, time.Now().Unix()/totpPeriod-1)); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestSecondFactorOfAllLogins(t *testing.T) {
+	testPackageinit()
+	testEncryptionKey(t)
+	u, err := CallForm{Call: "09122222222"}.StepsLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Email = "factors@test.com"
+	u.Identities = []string{"fake:factors"}
+	if err := u.Update(); err != nil {
+		t.Fatal(err)
+	}
+	enableTOTP(t, u)
+
+	result, err := SecureKeyForm{Identifier: u.Call, Key: u.SecureKey}.Login()
+	if err != nil || result.Complete() || result.Challenge == "" {
+		t.Error("secure key login without second factor", err)
+	}
+	result, err = (&Provider{Name: "fake"}).login(&IDClaims{Subject: "factors"})
+	if err != nil || result.Complete() || result.Challenge == "" {
+		t.Error("provider login without second factor", err)
+	}
+	u.Password, _ = MakePassword("secret")
+	u.Update()
+	result, err = new(User).AuthByCall(u.Call, "secret")
+	if err != nil || result.Complete() || result.Challenge == "" {
+		t.Error("password login without second factor", err)
+	}
+}
+
+func TestSecondFactorAttempts(t *testing.T) {
+	testPackageinit()
+	testEncryptionKey(t)
+	store := NewMemoryAttempts()
+	testLimiter(t, &Limiter{Store: store, FreeAttempts: 10, MaxFailures: 3,
+		OnLock: func(*User, string) {}})
+	form := Form{Email: "attempts@test.com", Password: "secret"}
+	u, err := form.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := enableTOTP(t, u)
+
+	(Form{Email: form.Email, Password: "wrong"}).Login()
+	result, err := form.Login()
+	if err != nil || result.Complete() {
+		t.Fatal("password login", err)
+	}
+	if a, _ := store.Get("id:" + u.Email); a.Failures != 1 {
+		t.Error("password failures are reset before second factor", a.Failures)
+	}
+	if u.Load(u.ID); !u.LastLogin.IsZero() {
+		t.Error("last login is set before second factor")
+	}
+	step := time.Now().Unix() / totpPeriod
+	if _, err := (SecondFactorForm{Challenge: result.Challenge, Code: totp(secret, step)}).Login(); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := store.Get("id:" + u.Email); a.Failures != 0 {
+		t.Error("password failures are not reset by second factor", a.Failures)
+	}
+	if u.Load(u.ID); u.LastLogin.IsZero() {
+		t.Error("last login is not set by second factor")
+	}
+
+	// wrong codes lock the account like passwords
+	result, _ = form.Login()
+	for i := 0; i < 3; i++ {
+		(SecondFactorForm{Challenge: result.Challenge, Code: "000000"}).Login()
+	}
+	if u.Load(u.ID); !u.Locked() {
+		t.Fatal("account is not locked by wrong codes")
+	}
+	if _, err := (SecondFactorForm{Challenge: result.Challenge, Code: totp(secret, step+1)}).Login(); err != ErrorLocked {
+		t.Error("second factor of locked account", err)
+	}
+}
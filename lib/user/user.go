@@ -1,6 +1,7 @@
 package user
 
 import (
+	"strings"
 	"time"
 
 	"github.com/jeyem/gocommerce/util/random"
@@ -10,6 +11,11 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
+const (
+	secureKeyLength = 5
+	secureKeyTTL    = time.Hour
+)
+
 type User struct {
 	ID                  bson.ObjectId `bson:"_id,omitempty"`
 	Email               string        `bson:"email"`
@@ -23,10 +29,21 @@ type User struct {
 	Role                string        `bson:"role"`
 	Call                string        `bson:"call"`
 	Avatar              string        `bson:"avatar"`
+	AvatarFile          bson.ObjectId `bson:"avatar_file,omitempty"`
+	LockedUntil         time.Time     `bson:"locked_until,omitempty"`
+	UnlockKey           string        `bson:"unlock_key,omitempty"`
 	CreatedAt           time.Time     `bson:"created_at"`
 	LastModified        time.Time     `bson:"last_modified"`
 	LastLogin           time.Time     `bson:"last_login"`
 	GoogleID            string        `bson:"google_id"`
+	Identities          []string      `bson:"identities,omitempty"`
+	Locale              string        `bson:"locale,omitempty"`
+	EmailVerified       bool          `bson:"email_verified"`
+	TOTPEnabled         bool          `bson:"totp_enabled"`
+	TOTPSecret          string        `bson:"totp_secret,omitempty"`
+	TOTPLastStep        int64         `bson:"totp_last_step,omitempty"`
+	RecoveryCodes       []string      `bson:"recovery_codes,omitempty"`
+	TokenVersion        int           `bson:"token_version,omitempty"`
 	Keywords            []string      `bson:"keywords"`
 }
 
@@ -43,7 +60,12 @@ func (u *User) Save() error {
 	if err := u.checkDuplicate(); err != nil {
 		return err
 	}
-	u.CreatedAt = time.Now()
+	if u.Role == "" {
+		u.Role = RoleCustomer
+	}
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now()
+	}
 	u.setKeywords()
 	return db.Create(u)
 }
@@ -61,74 +83,175 @@ func (u *User) LoadByMail(email string) error {
 	}).Find(u)
 }
 
+// loadByIdentifier loads user by email or call
+func (u *User) loadByIdentifier(identifier string) error {
+	identifier = fixIdentifier(identifier)
+	if strings.Contains(identifier, "@") {
+		return u.LoadByMail(identifier)
+	}
+	return u.LoadByCall(identifier)
+}
+
+// fixIdentifier normalizes email or call like they are stored
+func fixIdentifier(identifier string) string {
+	if strings.Contains(identifier, "@") {
+		return EmailFixer(identifier)
+	}
+	return CallFixer(identifier)
+}
+
 func (u User) checkDuplicate() error {
+	or := []bson.M{}
+	if u.Email != "" {
+		or = append(or, bson.M{"email": u.Email})
+	}
+	if u.Call != "" {
+		or = append(or, bson.M{"call": u.Call})
+	}
+	if len(or) == 0 {
+		return nil
+	}
+	query := bson.M{"$or": or}
+	if u.ID.Valid() {
+		query["_id"] = bson.M{"$ne": u.ID}
+	}
 	duplicateuser := new(User)
-	if err := db.Where(bson.M{"$or": []bson.M{
-		{"email": u.Email}, {"call": u.Call}},
-	}); err == nil {
+	if err := db.Where(query).Find(duplicateuser); err == nil {
 		return ErrorDuplicateUser
 	}
 	return nil
 }
 
+// LoadByCall loads user of call in any format CallFixer reads
 func (u *User) LoadByCall(cellphone string) error {
 	return db.Where(bson.M{
-		"call": cellphone,
+		"call": CallFixer(cellphone),
 	}).Find(u)
 }
 
-func (u *User) AuthByMail(email, password string) error {
-	if err := u.LoadByMail(email); err != nil {
-		return ErrorUserPass
+func (u *User) AuthByMail(email, password string) (*LoginResult, error) {
+	return u.authByMail(email, password, "")
+}
+
+func (u *User) authByMail(email, password, ip string) (*LoginResult, error) {
+	if err := limiter.guard(email, ip, func() error {
+		if err := u.LoadByMail(email); err != nil {
+			return ErrorUserPass
+		}
+		if ok := CheckPassword(password, u.Password); !ok {
+			return ErrorUserPass
+		}
+		// lock is only told to who knows the password
+		if u.Locked() {
+			return ErrorLocked
+		}
+		return nil
+	}); err != nil {
+		return nil, err
 	}
-	if ok := CheckPassword(password, u.Password); !ok {
-		return ErrorUserPass
+	u.rehash(password)
+	return u.login()
+}
+
+func (u *User) AuthByCall(call, password string) (*LoginResult, error) {
+	return u.authByCall(call, password, "")
+}
+
+func (u *User) authByCall(call, password, ip string) (*LoginResult, error) {
+	call = CallFixer(call)
+	if err := limiter.guard(call, ip, func() error {
+		if err := u.LoadByCall(call); err != nil {
+			return ErrorUserPass
+		}
+		if ok := CheckPassword(password, u.Password); !ok {
+			return ErrorUserPass
+		}
+		// lock is only told to who knows the password
+		if u.Locked() {
+			return ErrorLocked
+		}
+		return nil
+	}); err != nil {
+		return nil, err
 	}
-	u.LastLogin = time.Now()
-	return u.Update()
+	u.rehash(password)
+	return u.login()
 }
 
-func (u *User) AuthByCall(call, password string) error {
-	if err := u.LoadbyCall(call); err != nil {
-		return ErrorUserPass
+// rehash upgrades password hash of an old algorithm or parameters,
+// password is already checked
+func (u *User) rehash(password string) {
+	if !NeedsRehash(u.Password) {
+		return
 	}
-	if ok := CheckPassword(password, u.Password); !ok {
-		return ErrorUserPass
+	if hash, err := MakePassword(password); err == nil {
+		u.Password = hash
 	}
-	u.LastLogin = time.Now()
-	return u.Update()
 }
 
-func (u *User) AuthByCallAndSecureKey(call, key string) error {
-	if err := db.Where(bson.M{
-		"call":                   call,
-		"secure_key":             key,
-		"secure_key_expire_time": bson.M{"gt": time.Now()},
-	}).Find(u); err != nil {
-		return err
+func (u *User) AuthByCallAndSecureKey(call, key string) (*LoginResult, error) {
+	return u.authBySecureKey("call", CallFixer(call), key, "")
+}
+
+func (u *User) AuthByMailAndSecureKey(email, key string) (*LoginResult, error) {
+	return u.authBySecureKey("email", email, key, "")
+}
+
+// authBySecureKey logs in by field and secure key, the key is used up
+// by login and invalidated after limiter.KeyFailures wrong tries
+func (u *User) authBySecureKey(field, identifier, key, ip string) (*LoginResult, error) {
+	if err := limiter.guard(identifier, ip, func() error {
+		if err := db.Where(bson.M{
+			field:                    identifier,
+			"secure_key":             key,
+			"secure_key_expire_time": bson.M{"$gt": time.Now()},
+		}).Find(u); err != nil {
+			if limiter.failKey(identifier) {
+				invalidateSecureKey(field, identifier)
+			}
+			return err
+		}
+		if u.Locked() {
+			return ErrorLocked
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if field == "email" {
+		// the key was read from the inbox
+		u.EmailVerified = true
 	}
-	u.LastLogin = time.Now()
-	return u.Update()
+	// a used key can not be replayed, login saves u
+	u.SecureKey = ""
+	u.SecureKeyExpireTime = time.Time{}
+	return u.login()
 }
 
-func (u *User) AuthByMailAndSecureKey(email, key string) error {
-	if err := db.Where(bson.M{
-		"email":                  email,
-		"secure_key":             key,
-		"secure_key_expire_time": bson.M{"gt": time.Now()},
-	}).Find(u); err != nil {
-		return err
+func invalidateSecureKey(field, identifier string) {
+	u := new(User)
+	if err := db.Where(bson.M{field: identifier}).Find(u); err != nil {
+		return
 	}
-	u.LastLogin = time.Now()
-	return u.Update()
+	u.SecureKey = ""
+	u.SecureKeyExpireTime = time.Time{}
+	u.Update()
 }
 
 func (u *User) GenerateSecureKey() string {
-	u.SecureKey = random.Rand(5)
-	u.SecureKeyExpireTime = time.Now().Add(time.Hour)
+	u.SecureKey = random.OTP(secureKeyLength)
+	u.SecureKeyExpireTime = time.Now().Add(secureKeyTTL)
 	return u.SecureKey
 }
 
+// sendSecureKey notifies secure key through channel
+func (u *User) sendSecureKey(channel string) error {
+	return u.Notify(channel, MessageSecureKey, map[string]interface{}{
+		"Key":     u.SecureKey,
+		"Minutes": int(secureKeyTTL.Minutes()),
+	})
+}
+
 // minimal map responses
 func (u *User) Rest() echo.Map {
 	email := u.OrginEmail
@@ -0,0 +1,55 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/jeyem/gocommerce/util/repository"
+)
+
+func testPackageinit() {
+	RegisterRepository(repository.NewMemory())
+	SetHasher(testHasher)
+}
+
+func TestRegisterLogin(t *testing.T) {
+	testPackageinit()
+	form := Form{Fullname: "Test", Email: "Te.St@gmail.com", Password: "secret"}
+	u, err := form.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "test@gmail.com" {
+		t.Error("email is not fixed", u.Email)
+	}
+	if _, err := form.Register(); err != ErrorDuplicateUser {
+		t.Error("duplicate registered", err)
+	}
+	result, err := Form{Email: "test@gmail.com", Password: "secret"}.Login()
+	if err != nil || !result.Complete() || result.User.ID != u.ID {
+		t.Fatal("login", err)
+	}
+	if result.User.LastLogin.IsZero() {
+		t.Error("last login is not set")
+	}
+	if _, err := (Form{Email: "test@gmail.com", Password: "wrong"}).Login(); err != ErrorUserPass {
+		t.Error("login with wrong password", err)
+	}
+}
+
+func TestSecureKeyLogin(t *testing.T) {
+	testPackageinit()
+	u, err := CallForm{Call: "09120000000"}.StepsLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged, err := SecureKeyForm{Identifier: u.Call, Key: u.SecureKey}.Login()
+	if err != nil || !logged.Complete() || logged.User.ID != u.ID {
+		t.Fatal("secure key login", err)
+	}
+	if _, err := (SecureKeyForm{Identifier: u.Call, Key: u.SecureKey}).Login(); err == nil {
+		t.Error("secure key is used twice")
+	}
+	if _, err := (SecureKeyForm{Identifier: u.Call, Key: "wrong"}).Login(); err == nil {
+		t.Error("login with wrong secure key")
+	}
+}
@@ -0,0 +1,129 @@
+package user
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/labstack/echo"
+)
+
+const (
+	purposeVerify      = "verify_email"
+	purposeChangeEmail = "change_email"
+	verifyTTL          = 48 * time.Hour
+)
+
+type ChangeEmailForm struct {
+	Email    string `form:"email" json:"email" valid:"required,email"`
+	Password string `form:"password" json:"password" valid:"required"`
+}
+
+// SendVerification sends a token confirming current email of u
+func (u *User) SendVerification() error {
+	if u.Email == "" || u.EmailVerified {
+		return nil
+	}
+	token, err := issueToken(u, purposeVerify, u.Email, verifyTTL)
+	if err != nil {
+		return err
+	}
+	return u.Notify(ChannelEmail, MessageVerifyEmail, verifyData(u.OrginEmail, token))
+}
+
+// VerifyEmail marks email of token owner verified, tokens of an
+// email which is changed since are refused
+func VerifyEmail(token string) (*User, error) {
+	t, err := useToken(purposeVerify, token)
+	if err != nil {
+		return nil, err
+	}
+	u := new(User)
+	if err := u.Load(t.User); err != nil || u.Email != t.Value {
+		return nil, ErrorTokenInvalid
+	}
+	u.EmailVerified = true
+	return u, u.Update()
+}
+
+// ChangeEmail sends a confirmation token to the new address, email
+// of u stays the same until ConfirmEmailChange
+func (f ChangeEmailForm) ChangeEmail(u *User) error {
+	if _, err := govalidator.ValidateStruct(f); err != nil {
+		return err
+	}
+	if !CheckPassword(f.Password, u.Password) {
+		return ErrorUserPass
+	}
+	changed := *u
+	changed.Email = EmailFixer(f.Email)
+	changed.OrginEmail = f.Email
+	if err := changed.checkDuplicate(); err != nil {
+		return err
+	}
+	token, err := issueToken(u, purposeChangeEmail, f.Email, verifyTTL)
+	if err != nil {
+		return err
+	}
+	return changed.Notify(ChannelEmail, MessageVerifyEmail, verifyData(f.Email, token))
+}
+
+// ConfirmEmailChange switches email of token owner to the confirmed
+// address and tells the old address about it
+func ConfirmEmailChange(token string) (*User, error) {
+	t, err := useToken(purposeChangeEmail, token)
+	if err != nil {
+		return nil, err
+	}
+	u := new(User)
+	if err := u.Load(t.User); err != nil {
+		return nil, ErrorTokenInvalid
+	}
+	old := *u
+	u.Email = EmailFixer(t.Value)
+	u.OrginEmail = t.Value
+	// the address may be taken while waiting for confirmation
+	if err := u.checkDuplicate(); err != nil {
+		return nil, err
+	}
+	u.EmailVerified = true
+	if err := u.Save(); err != nil {
+		return nil, err
+	}
+	if old.Email != "" {
+		old.Notify(ChannelEmail, MessageEmailChanged, map[string]interface{}{
+			"Email": u.OrginEmail,
+		})
+	}
+	return u, nil
+}
+
+// Verified reports whether email of u is confirmed, users without
+// email are verified by their call
+func (u *User) Verified() bool {
+	return u.Email == "" || u.EmailVerified
+}
+
+// RequireVerified allows users with verified email, use after Authenticate
+func RequireVerified() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			u := FromContext(c)
+			if u == nil {
+				return unauthorized(c, ErrorTokenInvalid)
+			}
+			if !u.Verified() {
+				return c.JSON(http.StatusForbidden, echo.Map{"error": ErrorNotVerified.Error()})
+			}
+			return next(c)
+		}
+	}
+}
+
+func verifyData(email, token string) map[string]interface{} {
+	return map[string]interface{}{
+		"Email": email,
+		"Token": token,
+		"Hours": int(verifyTTL.Hours()),
+	}
+}
@@ -0,0 +1,99 @@
+package user
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// tokenOf reads token of last message sent to address
+func tokenOf(t *testing.T, n fakeNotifier, to string) string {
+	sent := n[to]
+	if len(sent) == 0 {
+		t.Fatal("nothing sent to", to)
+	}
+	return strings.Fields(sent[len(sent)-1].Body)[3]
+}
+
+func TestVerifyEmail(t *testing.T) {
+	testPackageinit()
+	notifier := testNotifier(t)
+	u, err := Form{Email: "verify@test.com", Password: "secret"}.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Verified() {
+		t.Fatal("registered email is verified")
+	}
+
+	e := echo.New()
+	e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusOK) },
+		func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				c.Set(contextUser, u)
+				return next(c)
+			}
+		}, RequireVerified())
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Error("unverified user allowed", rec.Code)
+	}
+
+	verified, err := VerifyEmail(tokenOf(t, notifier, "verify@test.com"))
+	if err != nil || !verified.Verified() {
+		t.Fatal("verify", err)
+	}
+	*u = *verified
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Error("verified user refused", rec.Code)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	testPackageinit()
+	notifier := testNotifier(t)
+	u, err := Form{Email: "old@test.com", Password: "secret"}.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken, _ := Form{Email: "taken@test.com", Password: "secret"}.Register()
+
+	if err := (ChangeEmailForm{Email: "new@test.com", Password: "wrong"}).ChangeEmail(u); err != ErrorUserPass {
+		t.Error("changed without password", err)
+	}
+	if err := (ChangeEmailForm{Email: "Taken@test.com", Password: "secret"}).ChangeEmail(u); err != ErrorDuplicateUser {
+		t.Error("changed to address of another user", err)
+	}
+	if err := (ChangeEmailForm{Email: "New@test.com", Password: "secret"}).ChangeEmail(u); err != nil {
+		t.Fatal(err)
+	}
+	token := tokenOf(t, notifier, "New@test.com")
+	if err := u.Load(u.ID); err != nil || u.Email != "old@test.com" {
+		t.Fatal("email changed before confirmation", u.Email)
+	}
+	if _, err := VerifyEmail(token); err != ErrorTokenInvalid {
+		t.Error("change token verified current email", err)
+	}
+	changed, err := ConfirmEmailChange(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.Email != "new@test.com" || changed.OrginEmail != "New@test.com" || !changed.EmailVerified {
+		t.Error("changed user", changed.Email, changed.OrginEmail, changed.EmailVerified)
+	}
+	if sent := notifier["old@test.com"]; sent[len(sent)-1].Subject != "Your email is changed" {
+		t.Error("old address is not told", sent)
+	}
+	if _, err := ConfirmEmailChange(token); err != ErrorTokenInvalid {
+		t.Error("change confirmed twice", err)
+	}
+	if taken.Email != "taken@test.com" {
+		t.Error("other user changed")
+	}
+}
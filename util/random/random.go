@@ -1,9 +1,13 @@
+// Package random generates keys, tokens and codes from crypto/rand,
+// characters are sampled uniformly from the given alphabet. A failing
+// system random source panics as nothing here is safe without it
 package random
 
 import (
-	"math/rand"
-	"strings"
-	"time"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
 )
 
 const (
@@ -11,21 +15,70 @@ const (
 	LowerCaseLetter = "abcdefghijklmnopqrstuvwxyz"
 	Number          = "1234567890"
 	Characters      = "!@$%^&*-+="
+	Hexadecimal     = "0123456789abcdef"
+	// URLSafe characters need no escaping in urls and file names
+	URLSafeLetter = UpperCaseLetter + LowerCaseLetter + Number + "-_"
+	// Unambiguous leaves out 0 O 1 I l for codes typed by people
+	Unambiguous = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
 )
 
-func Rand(length int, available ...string) (res string) {
-	randIN := ""
-	if len(available) < 1 {
-		randIN = Number
-	}
+// Rand returns length characters of available alphabets, numbers
+// when none is given
+func Rand(length int, available ...string) string {
+	alphabet := ""
 	for _, c := range available {
-		randIN += c
+		alphabet += c
+	}
+	if alphabet == "" {
+		alphabet = Number
+	}
+	return String(length, alphabet)
+}
+
+// String returns length characters of alphabet
+func String(length int, alphabet string) string {
+	chars := []rune(alphabet)
+	if len(chars) == 0 {
+		panic("random: empty alphabet")
+	}
+	res := make([]rune, length)
+	for i := range res {
+		res[i] = chars[Intn(len(chars))]
+	}
+	return string(res)
+}
+
+// Intn returns a uniform number in [0, n)
+func Intn(n int) int {
+	if n <= 0 {
+		panic("random: invalid argument to Intn")
 	}
-	randList := strings.Split(randIN, "")
-	rand.Seed(time.Now().Unix())
-	for i := 0; i < length; i++ {
-		index := rand.Intn(len(randList) - 1)
-		res += randList[index]
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err)
 	}
-	return res
+	return int(i.Int64())
+}
+
+func Bytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Hex is n random bytes as 2n hex characters
+func Hex(n int) string {
+	return hex.EncodeToString(Bytes(n))
+}
+
+// URLSafe is n random bytes as unpadded url safe base64
+func URLSafe(n int) string {
+	return base64.RawURLEncoding.EncodeToString(Bytes(n))
+}
+
+// OTP is a numeric one time code of digits length, it may start with 0
+func OTP(digits int) string {
+	return String(digits, "0123456789")
 }
@@ -0,0 +1,39 @@
+package random
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	seen := map[rune]int{}
+	for _, c := range String(2000, "abc") {
+		seen[c]++
+	}
+	// the last character of alphabet must be picked too
+	for _, c := range "abc" {
+		if seen[c] < 500 {
+			t.Errorf("%c picked %d times of 2000", c, seen[c])
+		}
+	}
+	if len(seen) != 3 {
+		t.Error("characters out of alphabet", seen)
+	}
+	if Rand(8) == Rand(8) {
+		t.Error("two calls returned same code")
+	}
+}
+
+func TestTokens(t *testing.T) {
+	if len(Hex(16)) != 32 {
+		t.Error("hex length")
+	}
+	token := URLSafe(32)
+	if strings.ContainsAny(token, "+/=") || len(token) != 43 {
+		t.Error("not url safe", token)
+	}
+	otp := OTP(6)
+	if len(otp) != 6 || strings.Trim(otp, "0123456789") != "" {
+		t.Error("otp", otp)
+	}
+}
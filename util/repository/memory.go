@@ -0,0 +1,514 @@
+package repository
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	ErrDuplicateID = errors.New("repository: duplicate id")
+	ErrNotModel    = errors.New("repository: model must be a struct pointer")
+)
+
+// memory keeps documents as bson.M per model type, it understands the
+// query operators used by lib packages: $or $and $exists $ne $in $nin
+// $gt $gte $lt $lte, arrays match any of their elements
+type memory struct {
+	mu          sync.RWMutex
+	collections map[string][]bson.M
+}
+
+// NewMemory is an empty Repository kept in memory, for tests and tools
+func NewMemory() Repository {
+	return &memory{collections: map[string][]bson.M{}}
+}
+
+func (m *memory) Create(model interface{}) error {
+	setID(model)
+	doc, err := toDoc(model)
+	if err != nil {
+		return err
+	}
+	name := collection(model)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.indexOf(name, doc["_id"]) >= 0 {
+		return ErrDuplicateID
+	}
+	m.collections[name] = append(m.collections[name], doc)
+	return nil
+}
+
+func (m *memory) Update(model interface{}) error {
+	doc, err := toDoc(model)
+	if err != nil {
+		return err
+	}
+	name := collection(model)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.indexOf(name, doc["_id"])
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.collections[name][i] = doc
+	return nil
+}
+
+func (m *memory) Get(model interface{}, id bson.ObjectId) error {
+	name := collection(model)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i := m.indexOf(name, id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	return fromDoc(m.collections[name][i], model)
+}
+
+func (m *memory) Where(query bson.M) Query {
+	return &memoryQuery{m: m, query: normalize(query)}
+}
+
+func (m *memory) Remove(model interface{}, query bson.M) (int, error) {
+	name := collection(model)
+	query = normalize(query)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := []bson.M{}
+	for _, doc := range m.collections[name] {
+		if !match(doc, query) {
+			kept = append(kept, doc)
+		}
+	}
+	removed := len(m.collections[name]) - len(kept)
+	m.collections[name] = kept
+	return removed, nil
+}
+
+func (m *memory) Upsert(model interface{}, selector, update bson.M) error {
+	name := collection(model)
+	selector = normalize(selector)
+	update = normalize(update)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var doc bson.M
+	for _, d := range m.collections[name] {
+		if match(d, selector) {
+			doc = d
+			break
+		}
+	}
+	if doc == nil {
+		doc = bson.M{"_id": bson.NewObjectId()}
+		for k, v := range selector {
+			if _, isOperator := operators(v); !strings.HasPrefix(k, "$") && !isOperator {
+				doc[k] = v
+			}
+		}
+		m.collections[name] = append(m.collections[name], doc)
+	}
+	for op, fields := range update {
+		values, ok := fields.(bson.M)
+		if !ok {
+			return errors.New("repository: not supported update " + op)
+		}
+		for k, v := range values {
+			switch op {
+			case "$set":
+				doc[k] = v
+			case "$inc":
+				doc[k] = add(doc[k], v)
+			default:
+				return errors.New("repository: not supported update " + op)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memory) indexOf(name string, id interface{}) int {
+	for i, doc := range m.collections[name] {
+		if equal(doc["_id"], id) {
+			return i
+		}
+	}
+	return -1
+}
+
+type memoryQuery struct {
+	m     *memory
+	query bson.M
+	sort  []string
+	limit int
+	page  int
+}
+
+func (q *memoryQuery) Sort(fields ...string) Query {
+	q.sort = fields
+	return q
+}
+
+func (q *memoryQuery) Paginate(limit, page int) Query {
+	q.limit = limit
+	q.page = page
+	return q
+}
+
+func (q *memoryQuery) Find(result interface{}) error {
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr {
+		return ErrNotModel
+	}
+	docs := q.matches(collection(result))
+	if rv.Elem().Kind() != reflect.Slice {
+		if len(docs) == 0 {
+			return ErrNotFound
+		}
+		return fromDoc(docs[0], result)
+	}
+	slice := reflect.MakeSlice(rv.Elem().Type(), len(docs), len(docs))
+	for i, doc := range docs {
+		if err := fromDoc(doc, slice.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	rv.Elem().Set(slice)
+	return nil
+}
+
+func (q *memoryQuery) Count(model interface{}) (int, error) {
+	q.m.mu.RLock()
+	defer q.m.mu.RUnlock()
+	count := 0
+	for _, doc := range q.m.collections[collection(model)] {
+		if match(doc, q.query) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (q *memoryQuery) matches(name string) []bson.M {
+	q.m.mu.RLock()
+	docs := []bson.M{}
+	for _, doc := range q.m.collections[name] {
+		if match(doc, q.query) {
+			docs = append(docs, doc)
+		}
+	}
+	q.m.mu.RUnlock()
+	if len(q.sort) > 0 {
+		sort.SliceStable(docs, func(i, j int) bool {
+			for _, field := range q.sort {
+				desc := strings.HasPrefix(field, "-")
+				field = strings.TrimPrefix(field, "-")
+				a, aok := lookup(docs[i], field)
+				b, bok := lookup(docs[j], field)
+				c := compareMissing(a, aok, b, bok)
+				if c == 0 {
+					continue
+				}
+				if desc {
+					return c > 0
+				}
+				return c < 0
+			}
+			return false
+		})
+	}
+	if q.limit > 0 {
+		skip := 0
+		if q.page > 1 {
+			skip = (q.page - 1) * q.limit
+		}
+		if skip >= len(docs) {
+			return nil
+		}
+		docs = docs[skip:]
+		if len(docs) > q.limit {
+			docs = docs[:q.limit]
+		}
+	}
+	return docs
+}
+
+func match(doc bson.M, query bson.M) bool {
+	for key, cond := range query {
+		switch key {
+		case "$or":
+			matched := false
+			for _, sub := range list(cond) {
+				if q, ok := sub.(bson.M); ok && match(doc, q) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		case "$and":
+			for _, sub := range list(cond) {
+				if q, ok := sub.(bson.M); !ok || !match(doc, q) {
+					return false
+				}
+			}
+		default:
+			value, exists := lookup(doc, key)
+			if !matchValue(value, exists, cond) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func matchValue(value interface{}, exists bool, cond interface{}) bool {
+	ops, ok := operators(cond)
+	if !ok {
+		if !exists {
+			return cond == nil
+		}
+		return equal(value, cond)
+	}
+	for op, arg := range ops {
+		switch op {
+		case "$exists":
+			if exists != truthy(arg) {
+				return false
+			}
+		case "$ne":
+			if exists && equal(value, arg) {
+				return false
+			}
+		case "$in":
+			found := false
+			for _, v := range list(arg) {
+				if exists && equal(value, v) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		case "$nin":
+			for _, v := range list(arg) {
+				if exists && equal(value, v) {
+					return false
+				}
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			if !exists {
+				return false
+			}
+			c, ok := compare(value, arg)
+			if !ok {
+				return false
+			}
+			if (op == "$gt" && c <= 0) || (op == "$gte" && c < 0) ||
+				(op == "$lt" && c >= 0) || (op == "$lte" && c > 0) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// operators returns cond as map when all of its keys are operators
+func operators(cond interface{}) (bson.M, bool) {
+	m, ok := cond.(bson.M)
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+func lookup(doc bson.M, key string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, part := range strings.Split(key, ".") {
+		m, ok := current.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// equal compares stored value with query value, arrays match
+// when any element is equal
+func equal(value, cond interface{}) bool {
+	if items, ok := value.([]interface{}); ok {
+		if _, condIsList := cond.([]interface{}); !condIsList {
+			for _, item := range items {
+				if equal(item, cond) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	if c, ok := compare(value, cond); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(value, cond)
+}
+
+func compareMissing(a interface{}, aok bool, b interface{}, bok bool) int {
+	switch {
+	case !aok && !bok:
+		return 0
+	case !aok:
+		return -1
+	case !bok:
+		return 1
+	}
+	c, _ := compare(a, b)
+	return c
+}
+
+// compare orders values of same bson kind
+func compare(a, b interface{}) (int, bool) {
+	if fa, ok := number(a); ok {
+		fb, ok := number(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch va := a.(type) {
+	case string:
+		if vb, ok := b.(string); ok {
+			return strings.Compare(va, vb), true
+		}
+	case bson.ObjectId:
+		if vb, ok := b.(bson.ObjectId); ok {
+			return strings.Compare(string(va), string(vb)), true
+		}
+	case time.Time:
+		if vb, ok := b.(time.Time); ok {
+			switch {
+			case va.Before(vb):
+				return -1, true
+			case va.After(vb):
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if vb, ok := b.(bool); ok {
+			switch {
+			case va == vb:
+				return 0, true
+			case !va:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func add(a, b interface{}) interface{} {
+	ia, aInt := a.(int)
+	ib, bInt := b.(int)
+	if (a == nil || aInt) && bInt {
+		return ia + ib
+	}
+	fa, _ := number(a)
+	fb, _ := number(b)
+	return fa + fb
+}
+
+func truthy(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	n, ok := number(v)
+	return ok && n != 0
+}
+
+func list(v interface{}) []interface{} {
+	items, _ := v.([]interface{})
+	return items
+}
+
+// normalize round trips query through bson so its values have the
+// same types and time precision as stored documents
+func normalize(query bson.M) bson.M {
+	data, err := bson.Marshal(query)
+	if err != nil {
+		return query
+	}
+	normalized := bson.M{}
+	if err := bson.Unmarshal(data, &normalized); err != nil {
+		return query
+	}
+	return normalized
+}
+
+func collection(model interface{}) string {
+	t := reflect.TypeOf(model)
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t.PkgPath() + "." + t.Name()
+}
+
+func toDoc(model interface{}) (bson.M, error) {
+	data, err := bson.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	return doc, bson.Unmarshal(data, &doc)
+}
+
+func fromDoc(doc bson.M, model interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(model)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return ErrNotModel
+	}
+	v.Elem().Set(reflect.Zero(v.Elem().Type()))
+	return bson.Unmarshal(data, model)
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type item struct {
+	ID        bson.ObjectId `bson:"_id,omitempty"`
+	Owner     string        `bson:"owner"`
+	Size      int           `bson:"size"`
+	Tags      []string      `bson:"tags"`
+	CreatedAt time.Time     `bson:"created_at"`
+	DeletedAt time.Time     `bson:"deleted_at,omitempty"`
+}
+
+func TestMemory(t *testing.T) {
+	repo := NewMemory()
+	now := time.Now()
+	items := []*item{
+		{Owner: "a", Size: 3, Tags: []string{"x"}, CreatedAt: now},
+		{Owner: "a", Size: 1, Tags: []string{"y"}, CreatedAt: now.Add(time.Second)},
+		{Owner: "b", Size: 2, Tags: []string{"x", "y"}, CreatedAt: now.Add(2 * time.Second), DeletedAt: now},
+	}
+	for _, it := range items {
+		if err := repo.Create(it); err != nil {
+			t.Fatal(err)
+		}
+		if !it.ID.Valid() {
+			t.Fatal("id not set on create")
+		}
+	}
+	if err := repo.Create(items[0]); err != ErrDuplicateID {
+		t.Error("duplicate id created", err)
+	}
+
+	got := new(item)
+	if err := repo.Get(got, items[1].ID); err != nil || got.Size != 1 {
+		t.Error("get", got, err)
+	}
+	if err := repo.Get(got, bson.NewObjectId()); err != ErrNotFound {
+		t.Error("get missing", err)
+	}
+
+	items[1].Size = 5
+	if err := repo.Update(items[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query bson.M
+		count int
+	}{
+		{bson.M{"owner": "a"}, 2},
+		{bson.M{"tags": "x"}, 2},
+		{bson.M{"size": bson.M{"$gte": 3}}, 2},
+		{bson.M{"size": bson.M{"$in": []int{2, 3}}}, 2},
+		{bson.M{"owner": bson.M{"$ne": "a"}}, 1},
+		{bson.M{"deleted_at": bson.M{"$exists": false}}, 2},
+		{bson.M{"created_at": bson.M{"$gt": now}}, 2},
+		{bson.M{"$or": []bson.M{{"owner": "b"}, {"size": 5}}}, 2},
+	}
+	for _, test := range tests {
+		count, err := repo.Where(test.query).Count(&item{})
+		if err != nil || count != test.count {
+			t.Error(test.query, "matched", count, "expected", test.count, err)
+		}
+	}
+
+	sorted := []item{}
+	if err := repo.Where(bson.M{}).Sort("-size").Paginate(2, 1).Find(&sorted); err != nil {
+		t.Fatal(err)
+	}
+	if len(sorted) != 2 || sorted[0].Size != 5 || sorted[1].Size != 3 {
+		t.Error("sort and paginate", sorted)
+	}
+
+	if err := repo.Upsert(&item{}, bson.M{"owner": "c"},
+		bson.M{"$inc": bson.M{"size": 2}}); err != nil {
+		t.Fatal(err)
+	}
+	repo.Upsert(&item{}, bson.M{"owner": "c"}, bson.M{"$inc": bson.M{"size": 2}})
+	if err := repo.Where(bson.M{"owner": "c"}).Find(got); err != nil || got.Size != 4 {
+		t.Error("upsert", got, err)
+	}
+
+	removed, err := repo.Remove(&item{}, bson.M{"owner": "a"})
+	if err != nil || removed != 2 {
+		t.Error("removed", removed, err)
+	}
+}
@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"github.com/jeyem/mogo"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type mongo struct {
+	db *mogo.DB
+}
+
+// NewMongo is Repository backed by mogo
+func NewMongo(db *mogo.DB) Repository {
+	return &mongo{db: db}
+}
+
+func (m *mongo) Create(model interface{}) error {
+	setID(model)
+	return m.db.Create(model)
+}
+
+func (m *mongo) Update(model interface{}) error {
+	return m.db.Update(model)
+}
+
+func (m *mongo) Get(model interface{}, id bson.ObjectId) error {
+	return m.db.Get(model, id)
+}
+
+func (m *mongo) Where(query bson.M) Query {
+	return &mongoQuery{q: m.db.Where(query)}
+}
+
+func (m *mongo) Remove(model interface{}, query bson.M) (int, error) {
+	info, err := m.db.Collection(model).RemoveAll(query)
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+func (m *mongo) Upsert(model interface{}, selector, update bson.M) error {
+	_, err := m.db.Collection(model).Upsert(selector, update)
+	return err
+}
+
+type mongoQuery struct {
+	q *mogo.Query
+}
+
+func (q *mongoQuery) Sort(fields ...string) Query {
+	q.q = q.q.Sort(fields...)
+	return q
+}
+
+func (q *mongoQuery) Paginate(limit, page int) Query {
+	q.q = q.q.Paginate(limit, page)
+	return q
+}
+
+func (q *mongoQuery) Find(result interface{}) error {
+	return q.q.Find(result)
+}
+
+func (q *mongoQuery) Count(model interface{}) (int, error) {
+	return q.q.Count(model)
+}
@@ -0,0 +1,62 @@
+// Package repository keeps lib packages independent of mongo, models are
+// structs with an `bson:"_id"` ObjectId field and queries are bson.M
+package repository
+
+import (
+	"reflect"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrNotFound is returned by Get and single Find when nothing matches
+var ErrNotFound = mgo.ErrNotFound
+
+type Repository interface {
+	// Create inserts model and sets its ID when not valid
+	Create(model interface{}) error
+	// Update replaces stored model having same ID
+	Update(model interface{}) error
+	Get(model interface{}, id bson.ObjectId) error
+	Where(query bson.M) Query
+	// Remove deletes documents of model collection matching query
+	Remove(model interface{}, query bson.M) (int, error)
+	// Upsert applies $set and $inc of update on document matching
+	// selector, creating it from selector when missing
+	Upsert(model interface{}, selector, update bson.M) error
+}
+
+type Query interface {
+	// Sort by fields, "-" prefix sorts descending
+	Sort(fields ...string) Query
+	// Paginate returns page of limit documents, pages start from 1
+	Paginate(limit, page int) Query
+	// Find loads first match into struct pointer or all into slice pointer
+	Find(result interface{}) error
+	Count(model interface{}) (int, error)
+}
+
+// setID gives model a new ObjectId when its id field is not valid
+func setID(model interface{}) {
+	v := reflect.ValueOf(model)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("bson"), ",")[0]
+		if tag != "_id" {
+			continue
+		}
+		field := v.Field(i)
+		id, ok := field.Interface().(bson.ObjectId)
+		if ok && !id.Valid() && field.CanSet() {
+			field.Set(reflect.ValueOf(bson.NewObjectId()))
+		}
+		return
+	}
+}